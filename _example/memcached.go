@@ -121,13 +121,19 @@ func (m MemcachedPlugin) GraphDefinition() map[string]mackerelplugin.Graphs {
 func main() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "11211", "Port")
-	optTempfile := flag.String("tempfile", "", "Temp file name")
+	flags := mackerelplugin.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	if flags.Version {
+		fmt.Println("mackerel-plugin-memcached 0.1.0")
+		return
+	}
 
 	var memcached MemcachedPlugin
 
 	memcached.Target = fmt.Sprintf("%s:%s", *optHost, *optPort)
 	helper := mackerelplugin.NewMackerelPlugin(memcached)
-	helper.Tempfile = *optTempfile
+	if err := flags.Apply(helper); err != nil {
+		log.Fatalln(err)
+	}
 	helper.Run()
 }
@@ -0,0 +1,125 @@
+package mackerelplugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CompositePlugin combines several independent plugins into one,
+// for example OS-level and application-level metrics in a single binary.
+//
+// Graph keys of each plugin are prefixed with its MetricKeyPrefix if it implements PluginWithPrefix.
+// Values are keyed with their graph keys, so the same metric names of different plugins never collide.
+// Graph definitions of the plugins are merged on each call, so they may change at runtime.
+type CompositePlugin struct {
+	plugins []compositeMember
+}
+
+type compositeMember struct {
+	member
+	prefix string
+}
+
+// NewCompositePlugin returns new CompositePlugin.
+// It returns an error if graph keys of the plugins collide.
+func NewCompositePlugin(plugins ...Plugin) (*CompositePlugin, error) {
+	c := &CompositePlugin{}
+	for i, p := range plugins {
+		m := compositeMember{member: member{name: fmt.Sprintf("plugin %d", i), plugin: p, fetcher: &fetcher{}}}
+		if pp, ok := p.(PluginWithPrefix); ok {
+			m.prefix = pp.MetricKeyPrefix()
+			m.name += " (" + m.prefix + ")"
+		}
+		c.plugins = append(c.plugins, m)
+	}
+	if _, _, err := c.mergeGraphs(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// mergeGraphs merges current graph definitions of the plugins with prefixed graph keys.
+// It also returns graph definitions of each plugin without the ones whose keys collide with earlier plugins,
+// and a DefinitionError if any keys collide.
+func (c *CompositePlugin) mergeGraphs() (map[string]Graphs, []map[string]Graphs, error) {
+	merged := make(map[string]Graphs)
+	owned := make([]map[string]Graphs, len(c.plugins))
+	var collisions []string
+	for i, m := range c.plugins {
+		owned[i] = make(map[string]Graphs)
+		for key, graph := range m.plugin.GraphDefinition() {
+			k := m.graphKey(key)
+			if _, ok := merged[k]; ok {
+				collisions = append(collisions, k)
+				continue
+			}
+			merged[k] = graph
+			owned[i][key] = graph
+		}
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return merged, owned, &DefinitionError{Err: fmt.Errorf("graph keys collide: %s", strings.Join(collisions, ", "))}
+	}
+	return merged, owned, nil
+}
+
+func (m compositeMember) graphKey(key string) string {
+	if m.prefix == "" {
+		return key
+	}
+	if key == "" {
+		return m.prefix
+	}
+	return m.prefix + "." + key
+}
+
+// GraphDefinition implements Plugin.
+// If graph keys collide, the graph of the earlier plugin is returned.
+func (c *CompositePlugin) GraphDefinition() map[string]Graphs {
+	graphs, _, _ := c.mergeGraphs()
+	return graphs
+}
+
+// usesQualifiedKeys tells that values are keyed with their graph keys, so the same metric names
+// in different graphs never collide.
+func (c *CompositePlugin) usesQualifiedKeys() bool {
+	return true
+}
+
+// FetchMetrics implements Plugin
+func (c *CompositePlugin) FetchMetrics() (map[string]float64, error) {
+	return c.FetchMetricsContext(context.Background())
+}
+
+// FetchMetricsContext implements PluginWithContext
+func (c *CompositePlugin) FetchMetricsContext(ctx context.Context) (map[string]float64, error) {
+	stat, err := c.FetchMetricValues(ctx)
+	return float64Values(stat), err
+}
+
+// FetchMetricValues implements PluginWithValues.
+// Plugins are fetched concurrently. Plugins which fail to fetch metrics are skipped and reported
+// by a PartialError; it returns other errors only if all plugins fail.
+func (c *CompositePlugin) FetchMetricValues(ctx context.Context) (map[string]Value, error) {
+	members := make([]member, len(c.plugins))
+	for i, m := range c.plugins {
+		members[i] = m.member
+	}
+	// Graph definitions may be updated while fetching metrics.
+	var owned []map[string]Graphs
+	return fetchMembers(ctx, members, func(i int, dst map[string]Value, src map[string]Value) error {
+		if owned == nil {
+			var err error
+			if _, owned, err = c.mergeGraphs(); err != nil {
+				return err
+			}
+		}
+		m := c.plugins[i]
+		return walkValues(owned[i], usesQualifiedKeys(m.plugin), src, func(key string, name string, v Value) {
+			dst[joinKey(m.graphKey(key), name)] = v
+		})
+	})
+}
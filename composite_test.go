@@ -0,0 +1,162 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPSameNames struct{}
+
+func (t testPSameNames) FetchMetrics() (map[string]float64, error) {
+	return map[string]float64{"cmd_get": 20}, nil
+}
+
+func (t testPSameNames) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"app.cmd": {
+			Metrics: []Metrics{
+				{Name: "cmd_get"},
+			},
+		},
+	}
+}
+
+func TestCompositePlugin(t *testing.T) {
+	c, err := NewCompositePlugin(testP{}, testMemcachedPlugin{}, testPSameNames{}, testPWithWildcard{}, testPFailing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := NewMackerelPlugin(c)
+	if problems := mp.Validate(); problems != nil {
+		t.Errorf("Validate = %q; want nil", problems)
+	}
+
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	var pe *PartialError
+	if err := mp.OutputValuesE(); !errors.As(err, &pe) {
+		t.Errorf("OutputValuesE should return a PartialError: %v", err)
+	} else if !strings.Contains(err.Error(), "plugin 4:") {
+		t.Errorf("OutputValuesE should tell which plugin fails: %v", err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("testP.bar\t15\t%[1]d\n"+
+		"testP.fuga.baz\t18\t%[1]d\n"+
+		"memcached.cmd.cmd_get\t11\t%[1]d\n"+
+		"app.cmd.cmd_get\t20\t%[1]d\n"+
+		"testPWithWildcard.piyo.1.bar\t11\t%[1]d\n"+
+		"testPWithWildcard.piyo.2.bar\t12\t%[1]d\n"+
+		"testPWithWildcard.piyo.3.bar\t13\t%[1]d\n"+
+		"testPWithWildcard.fuga.baz\t18\t%[1]d\n", epoch)
+	if got := wtr.String(); sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid :%s", got)
+	}
+
+	wtr = &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputDefinitionsE(); err != nil {
+		t.Fatal(err)
+	}
+	expect = `# mackerel-agent-plugin
+{"graphs":{"app.cmd":{"label":"App Cmd","unit":"","metrics":[{"name":"cmd_get","label":"Cmd Get","stacked":false}]},"hoge":{"label":"Hoge","unit":"","metrics":[{"name":"hoge1","label":"hoge1","stacked":false}]},"memcached.cmd":{"label":"Memcached Command","unit":"integer","metrics":[{"name":"cmd_get","label":"Get","stacked":false}]},"testP":{"label":"TestP","unit":"integer","metrics":[{"name":"bar","label":"Bar","stacked":false}]},"testP.fuga":{"label":"TestP Fuga","unit":"float","metrics":[{"name":"baz","label":"Baz","stacked":false}]},"testPWithWildcard.fuga":{"label":"TestPWithWildcard Fuga","unit":"","metrics":[{"name":"baz","label":"Baz","stacked":false}]},"testPWithWildcard.piyo.#":{"label":"TestPWithWildcard Piyo","unit":"","metrics":[{"name":"bar","label":"Bar","stacked":false}]}}}
+`
+	if got := wtr.String(); got != expect {
+		t.Errorf("result of OutputDefinitions is invalid: %s", got)
+	}
+}
+
+func TestCompositePluginCollision(t *testing.T) {
+	_, err := NewCompositePlugin(testMemcachedPlugin{}, testMemcachedPlugin{})
+	var defErr *DefinitionError
+	if !errors.As(err, &defErr) {
+		t.Errorf("NewCompositePlugin: %v; want *DefinitionError", err)
+	}
+}
+
+func TestCompositePluginAllFailed(t *testing.T) {
+	c, err := NewCompositePlugin(testPFailing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics should return an error if all plugins fail")
+	}
+}
+
+func TestCompositePluginNested(t *testing.T) {
+	inner, err := NewCompositePlugin(testP{}, testPSameNames{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCompositePlugin(inner, testPWithWildcard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := c.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"testP.bar":                    15,
+		"testP.fuga.baz":               18,
+		"app.cmd.cmd_get":              20,
+		"testPWithWildcard.piyo.1.bar": 11,
+		"testPWithWildcard.piyo.2.bar": 12,
+		"testPWithWildcard.piyo.3.bar": 13,
+		"testPWithWildcard.fuga.baz":   18,
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics = %v; want %v", stat, want)
+	}
+}
+
+// testPDiscovering defines a graph for each disk discovered while fetching metrics.
+type testPDiscovering struct {
+	disks  []string
+	graphs map[string]Graphs
+}
+
+func (t *testPDiscovering) FetchMetrics() (map[string]float64, error) {
+	stat := make(map[string]float64)
+	for _, disk := range t.disks {
+		t.graphs["disk."+disk] = Graphs{Metrics: []Metrics{{Name: disk + "_reads"}}}
+		stat[disk+"_reads"] = 10
+	}
+	return stat, nil
+}
+
+func (t *testPDiscovering) GraphDefinition() map[string]Graphs {
+	return t.graphs
+}
+
+func TestCompositePluginWithChangingDefinitions(t *testing.T) {
+	p := &testPDiscovering{graphs: make(map[string]Graphs)}
+	c, err := NewCompositePlugin(p, testPSameNames{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.disks = []string{"sda"}
+	stat, err := c.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"disk.sda.sda_reads": 10, "app.cmd.cmd_get": 20}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics = %v; want %v", stat, want)
+	}
+	if _, ok := c.GraphDefinition()["disk.sda"]; !ok {
+		t.Errorf("GraphDefinition should contain graphs defined while fetching metrics: %v", c.GraphDefinition())
+	}
+
+	// A graph added at runtime collides with the one of testPSameNames.
+	p.graphs["app.cmd"] = Graphs{Metrics: []Metrics{{Name: "cmd_get"}}}
+	var defErr *DefinitionError
+	if _, err := c.FetchMetrics(); !errors.As(err, &defErr) {
+		t.Errorf("FetchMetrics: %v; want *DefinitionError", err)
+	}
+}
@@ -0,0 +1,53 @@
+package mackerelplugin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// debugRow is a line of the debug output, which shows how the value is calculated.
+type debugRow struct {
+	key     string
+	raw     string
+	last    string
+	elapsed string
+	diff    string
+	scale   string
+	value   string
+}
+
+func (mp *MackerelPlugin) debugEnabled() bool {
+	return mp.Debug || os.Getenv("MACKEREL_PLUGIN_DEBUG") != ""
+}
+
+func newDebugRow(key string, raw string, metric Metrics) *debugRow {
+	row := &debugRow{key: key, raw: raw, last: "-", elapsed: "-", diff: "-", scale: "-", value: "-"}
+	if metric.Scale != 0 {
+		row.scale = formatDebugFloat(metric.Scale)
+	}
+	return row
+}
+
+func (r *debugRow) setDiff(lastValue Value, now time.Time, lastTime time.Time, diff Value, err error) {
+	r.last = lastValue.String()
+	r.elapsed = formatDebugFloat(now.Sub(lastTime).Seconds())
+	if err != nil {
+		r.diff = "error: " + err.Error()
+	} else {
+		r.diff = diff.String()
+	}
+}
+
+func (mp *MackerelPlugin) printDebugHeader() {
+	fmt.Fprintln(mp.getWriter(), "# key\traw\tlast\telapsed\tdiff\tscale\tvalue") // nolint
+}
+
+func (mp *MackerelPlugin) printDebugRow(r *debugRow) {
+	fmt.Fprintf(mp.getWriter(), "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.key, r.raw, r.last, r.elapsed, r.diff, r.scale, r.value) // nolint
+}
+
+func formatDebugFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,72 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testPDebug struct{}
+
+func (t testPDebug) FetchMetrics() (map[string]float64, error) {
+	return map[string]float64{
+		"cmd_get": 1000,
+		"cmd_set": 10,
+		"memory":  2,
+	}, nil
+}
+
+func (t testPDebug) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"memcached.cmd": {
+			Metrics: []Metrics{
+				{Name: "cmd_get", Diff: true, Scale: 0.5},
+				{Name: "cmd_set", Diff: true},
+				{Name: "get_ratio", Expr: "cmd_get / 100"},
+			},
+		},
+		"memcached.memory": {
+			Metrics: []Metrics{
+				{Name: "memory", Scale: 1024},
+			},
+		},
+	}
+}
+
+func TestOutputValuesWithDebug(t *testing.T) {
+	mp := NewMackerelPlugin(testPDebug{})
+	mp.Debug = true
+	mp.StateStore = &MemoryStateStore{}
+	now := time.Now()
+	mp.Clock = &testClock{now: now}
+	state := &State{
+		Values: map[string]Value{"cmd_get": Float(400), "cmd_set": Float(20)},
+		Time:   now.Add(-time.Minute),
+	}
+	if err := mp.StateStore.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "# key\traw\tlast\telapsed\tdiff\tscale\tvalue\n" +
+		"memcached.cmd.cmd_get\t1000\t400\t60\t600\t0.5\t300\n" +
+		"memcached.cmd.cmd_set\t10\t20\t60\terror: counter seems to be reset\t-\t-\n" +
+		"memcached.cmd.get_ratio\t=cmd_get / 100\t-\t-\t-\t-\t3\n" +
+		"memcached.memory.memory\t2\t-\t-\t-\t1024\t2048\n"
+	if got := wtr.String(); sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid:\n%s", got)
+	}
+
+	saved, err := mp.StateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Values, state.Values) {
+		t.Errorf("debug mode should not save the state: %v", saved.Values)
+	}
+}
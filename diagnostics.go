@@ -0,0 +1,73 @@
+package mackerelplugin
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Diagnosis represents drift between fetched metrics and graph definitions
+type Diagnosis struct {
+	// Unmapped is the fetched keys which match no metrics in graph definitions.
+	Unmapped []string
+	// Unpopulated is the metrics in graph definitions, as graph key and metric name joined with ".",
+	// which match no fetched keys. Derived metrics are not included.
+	Unpopulated []string
+}
+
+// Diagnose compares the fetched metrics with graph definitions.
+func (mp *MackerelPlugin) Diagnose(stat map[string]Value) Diagnosis {
+	mapped := make(map[string]bool)
+	var d Diagnosis
+	qualified := usesQualifiedKeys(mp.Plugin)
+	for key, graph := range mp.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			if metric.Expr != "" {
+				continue
+			}
+			populated := false
+			if strings.ContainsAny(key+metric.Name, "*#") {
+				re, err := regexp.Compile(`\A` + wildcardPattern(key+"."+metric.Name))
+				if err == nil {
+					for k := range stat {
+						if re.MatchString(k) {
+							mapped[k] = true
+							populated = true
+						}
+					}
+				}
+			} else {
+				if k, _, ok := lookupValue(stat, key, metric, qualified); ok {
+					mapped[k] = true
+					populated = true
+				}
+			}
+			if !populated {
+				d.Unpopulated = append(d.Unpopulated, joinKey(key, metric.Name))
+			}
+		}
+	}
+	for k := range stat {
+		if !mapped[k] {
+			d.Unmapped = append(d.Unmapped, k)
+		}
+	}
+	sort.Strings(d.Unmapped)
+	sort.Strings(d.Unpopulated)
+	return d
+}
+
+func (mp *MackerelPlugin) diagnosticsEnabled() bool {
+	return mp.Diagnostics || os.Getenv("MACKEREL_PLUGIN_DIAGNOSTICS") != ""
+}
+
+func (mp *MackerelPlugin) logDiagnosis(stat map[string]Value) {
+	d := mp.Diagnose(stat)
+	for _, k := range d.Unmapped {
+		mp.logger().Printf("Diagnostics: %s is fetched but not defined in graph definitions\n", k)
+	}
+	for _, k := range d.Unpopulated {
+		mp.logger().Printf("Diagnostics: %s is defined but not fetched\n", k)
+	}
+}
@@ -0,0 +1,57 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	mp := NewMackerelPlugin(testPWithWildcard{})
+	d := mp.Diagnose(map[string]Value{
+		"piyo.1.bar":  Float(11),
+		"piyo.1.qux":  Float(12),
+		"baz_renamed": Float(18),
+	})
+	want := Diagnosis{
+		Unmapped:    []string{"baz_renamed", "piyo.1.qux"},
+		Unpopulated: []string{"fuga.baz"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Diagnose = %+v; want %+v", d, want)
+	}
+
+	d = mp.Diagnose(map[string]Value{"baz": Float(18)})
+	want = Diagnosis{Unpopulated: []string{"piyo.#.bar"}}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Diagnose = %+v; want %+v", d, want)
+	}
+}
+
+func TestOutputValuesWithDiagnostics(t *testing.T) {
+	logs := &bytes.Buffer{}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(logs)
+
+	mp := NewMackerelPlugin(testP{})
+	mp.Writer = &bytes.Buffer{}
+	mp.Diagnostics = true
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	if s := logs.String(); strings.Contains(s, "Diagnostics") {
+		t.Errorf("no diagnostics should be logged: %s", s)
+	}
+
+	mp = NewMackerelPlugin(testMemcachedPlugin{})
+	mp.Writer = &bytes.Buffer{}
+	mp.Diagnostics = true
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	if s := logs.String(); !strings.Contains(s, "Diagnostics: cmd_set is fetched but not defined") {
+		t.Errorf("unmapped keys should be logged: %s", s)
+	}
+}
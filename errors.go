@@ -0,0 +1,67 @@
+package mackerelplugin
+
+import "fmt"
+
+// FetchError represents a failure of fetching metrics from a plugin
+type FetchError struct {
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return "failed to fetch metrics: " + e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// StateError represents a failure of reading or writing the state
+type StateError struct {
+	Op   string // "read", "write" or "lock"
+	Path string
+	Err  error
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("failed to %s state %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// DefinitionError represents an invalid graph definition
+type DefinitionError struct {
+	Key    string
+	Metric string
+	Err    error
+}
+
+func (e *DefinitionError) Error() string {
+	if e.Key == "" && e.Metric == "" {
+		return "invalid definition: " + e.Err.Error()
+	}
+	return fmt.Sprintf("invalid definition %q (metric %q): %v", e.Key, e.Metric, e.Err)
+}
+
+func (e *DefinitionError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned by FetchMetrics of a plugin which fetched some of the metrics
+// but failed to fetch the rest. The metrics fetched are output and saved as usual,
+// and then Run and OutputValues exit with ExitCodePartial.
+type PartialError struct {
+	Err error
+}
+
+// ExitCodePartial is the exit status of Run and OutputValues when the results are partial
+const ExitCodePartial = 2
+
+func (e *PartialError) Error() string {
+	return "partial results: " + e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,159 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exporter is an http.Handler which serves the metrics of MackerelPlugin
+// in the Prometheus text exposition format. It fetches metrics on each request
+// and keeps last values in memory to calculate differentials.
+// If the plugin does not implement PluginWithContext and a scrape times out, the next scrapes fail
+// until the abandoned fetch returns.
+type Exporter struct {
+	mp *MackerelPlugin
+
+	mu      sync.Mutex
+	last    *State
+	fetcher fetcher
+}
+
+// NewExporter returns new Exporter
+func NewExporter(mp *MackerelPlugin) *Exporter {
+	return &Exporter{mp: mp}
+}
+
+// ServeExporter serves the metrics on addr at /metrics until ctx is done.
+func (mp *MackerelPlugin) ServeExporter(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", NewExporter(mp))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Shutdown(context.Background()) // nolint
+		case <-done:
+		}
+	}()
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP implements http.Handler
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Each scrape writes into its own buffer with its own formatter,
+	// so a shallow copy of MackerelPlugin is used.
+	buf := &bytes.Buffer{}
+	mp := *e.mp
+	mp.Writer = buf
+	mp.Formatter = newExporterFormatter(mp.graphDefinitions())
+
+	now := mp.now()
+	stat, err := mp.fetchStat(r.Context(), &e.fetcher)
+	if err != nil {
+		mp.logger().Println("Exporter:", err)
+	}
+	var pe *PartialError
+	if err != nil && !errors.As(err, &pe) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	last := e.last
+	if last != nil && now.Sub(last.Time) < oldEnoughDuration {
+		last = nil
+	}
+	if err := mp.writeValues(stat, last, now); err != nil {
+		mp.logger().Println("Exporter:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Too frequent scrapes don't replace last values, so that differentials can be calculated.
+	if last != nil || e.last == nil {
+		e.last = mp.nextState(stat, last, now)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes()) // nolint
+}
+
+// exporterFormatter formats values with HELP and TYPE lines derived from graph definitions.
+type exporterFormatter struct {
+	metrics  map[string]exporterMetric
+	patterns []exporterPattern
+}
+
+type exporterMetric struct {
+	graph  Graphs
+	metric Metrics
+}
+
+type exporterPattern struct {
+	re *regexp.Regexp
+	exporterMetric
+}
+
+func newExporterFormatter(graphs map[string]Graphs) *exporterFormatter {
+	f := &exporterFormatter{metrics: make(map[string]exporterMetric)}
+	for k, g := range graphs {
+		for _, m := range g.Metrics {
+			key := joinKey(k, m.Name)
+			em := exporterMetric{graph: g, metric: m}
+			if !strings.ContainsAny(key, "*#") {
+				f.metrics[key] = em
+				continue
+			}
+			re, err := regexp.Compile(`\A` + wildcardPattern(key) + `\z`)
+			if err != nil {
+				continue
+			}
+			f.patterns = append(f.patterns, exporterPattern{re: re, exporterMetric: em})
+		}
+	}
+	return f
+}
+
+func (f *exporterFormatter) lookup(key string) (exporterMetric, bool) {
+	if m, ok := f.metrics[key]; ok {
+		return m, true
+	}
+	for _, p := range f.patterns {
+		if p.re.MatchString(key) {
+			return p.exporterMetric, true
+		}
+	}
+	return exporterMetric{}, false
+}
+
+// FormatValue implements Formatter.
+// Timestamps are omitted so that Prometheus uses the time of the scrape.
+func (f *exporterFormatter) FormatValue(w io.Writer, key string, value Value, t time.Time) error {
+	name := prometheusName(key)
+	if m, ok := f.lookup(key); ok {
+		if err := writePrometheusMetadata(w, name, m.graph, m.metric); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", name, value)
+	return err
+}
+
+// FormatDefinitions implements Formatter
+func (f *exporterFormatter) FormatDefinitions(w io.Writer, graphs map[string]Graphs) error {
+	return PrometheusFormatter{}.FormatDefinitions(w, graphs)
+}
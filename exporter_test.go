@@ -0,0 +1,77 @@
+package mackerelplugin
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close() // nolint
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", res.StatusCode, b)
+	}
+	return string(b)
+}
+
+func TestExporter(t *testing.T) {
+	e := NewExporter(NewMackerelPlugin(testPWithWildcard{}))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	expect := "# HELP testPWithWildcard_piyo_1_bar TestPWithWildcard Piyo: Bar\n# TYPE testPWithWildcard_piyo_1_bar gauge\ntestPWithWildcard_piyo_1_bar 11\n" +
+		"# HELP testPWithWildcard_piyo_2_bar TestPWithWildcard Piyo: Bar\n# TYPE testPWithWildcard_piyo_2_bar gauge\ntestPWithWildcard_piyo_2_bar 12\n" +
+		"# HELP testPWithWildcard_piyo_3_bar TestPWithWildcard Piyo: Bar\n# TYPE testPWithWildcard_piyo_3_bar gauge\ntestPWithWildcard_piyo_3_bar 13\n" +
+		"# HELP testPWithWildcard_fuga_baz TestPWithWildcard Fuga: Baz\n# TYPE testPWithWildcard_fuga_baz gauge\ntestPWithWildcard_fuga_baz 18\n"
+	got := scrape(t, srv.URL)
+	if sortLines(got) != sortLines(expect) {
+		t.Errorf("result of Exporter is invalid: %s", got)
+	}
+}
+
+func TestExporterCalculatesDiff(t *testing.T) {
+	var n int
+	clock := &testClock{now: time.Now()}
+	mp := NewMackerelPlugin(testPCounter{n: &n, cancel: func() {}})
+	mp.Clock = clock
+	e := NewExporter(mp)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	expect := "# HELP counter_gauge Counter: Gauge\n# TYPE counter_gauge gauge\ncounter_gauge 10\n"
+	if got := scrape(t, srv.URL); got != expect {
+		t.Errorf("first scrape should not contain differentials: %s", got)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	expect = "# HELP counter_count Counter: Count\n# TYPE counter_count gauge\ncounter_count 1\n" + expect
+	if got := scrape(t, srv.URL); sortLines(got) != sortLines(expect) {
+		t.Errorf("second scrape should contain differentials: %s", got)
+	}
+}
+
+func TestServeExporterWithAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint
+
+	mp := NewMackerelPlugin(testP{})
+	if err := mp.ServeExporter(context.Background(), l.Addr().String()); err == nil {
+		t.Error("ServeExporter should return an error if the address is in use")
+	}
+}
@@ -0,0 +1,204 @@
+package mackerelplugin
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// expr is a compiled expression of a derived metric.
+// It consists of numbers, metric names, +, -, *, / and parentheses.
+type expr interface {
+	eval(lookup func(name string) (float64, bool)) (float64, error)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	return float64(e), nil
+}
+
+type nameExpr string
+
+func (e nameExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, ok := lookup(string(e))
+	if !ok {
+		return 0, fmt.Errorf("%s does not exist", string(e))
+	}
+	return v, nil
+}
+
+type negExpr struct {
+	x expr
+}
+
+func (e negExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, err := e.x.eval(lookup)
+	return -v, err
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expr
+}
+
+func (e binaryExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	x, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.y.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	default:
+		return x / y, nil
+	}
+}
+
+// exprNames returns metric names referred by e.
+func exprNames(e expr) []string {
+	switch e := e.(type) {
+	case nameExpr:
+		return []string{string(e)}
+	case negExpr:
+		return exprNames(e.x)
+	case binaryExpr:
+		return append(exprNames(e.x), exprNames(e.y)...)
+	}
+	return nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// parseExpr compiles s into expr.
+// Metric names may contain hyphens, so binary minus must be separated by spaces.
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at %d in %q", p.s[p.pos], p.pos, p.s)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of %q", p.s)
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' in %q", p.s)
+		}
+		p.pos++
+		return x, nil
+	case isDigit(c) || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return numberExpr(v), nil
+	case isNameChar(c) && c != '-':
+		start := p.pos
+		for p.pos < len(p.s) && (isNameChar(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		return nameExpr(p.s[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in %q", c, p.pos, p.s)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || isDigit(c) || c == '_' || c == '-'
+}
@@ -0,0 +1,69 @@
+package mackerelplugin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	values := map[string]float64{
+		"get_hits":   30,
+		"get_misses": 10,
+		"bytes-read": 4,
+		"foo.bar":    2,
+	}
+	lookup := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"-get_hits + 40", 10},
+		{"get_hits / (get_hits + get_misses) * 100", 75},
+		{"bytes-read - 1", 3},
+		{"foo.bar * 0.5", 1},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.s)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.s, err)
+			continue
+		}
+		v, err := e.eval(lookup)
+		if err != nil {
+			t.Errorf("eval(%q): %v", tt.s, err)
+			continue
+		}
+		if v != tt.want {
+			t.Errorf("eval(%q) = %f; want %f", tt.s, v, tt.want)
+		}
+	}
+}
+
+func TestParseExprError(t *testing.T) {
+	for _, s := range []string{"", "1 +", "(1 + 2", "1 2", "a $ b", "1..2"} {
+		if _, err := parseExpr(s); err == nil {
+			t.Errorf("parseExpr(%q) should return an error", s)
+		}
+	}
+}
+
+func TestEvalExprWithUnknownName(t *testing.T) {
+	e, err := parseExpr("a + b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.eval(func(name string) (float64, bool) { return 1, name == "a" })
+	if err == nil {
+		t.Error("eval should return an error for unknown names")
+	}
+	if names := exprNames(e); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("exprNames = %v; want [a b]", names)
+	}
+}
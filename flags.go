@@ -0,0 +1,55 @@
+package mackerelplugin
+
+import (
+	"flag"
+	"time"
+)
+
+// Flags holds the command-line options common to all plugins
+type Flags struct {
+	Tempfile        string
+	MetricKeyPrefix string
+	Timeout         time.Duration
+	OutputFormat    string
+	Debug           bool
+	Version         bool
+}
+
+// RegisterFlags registers the common options on fs:
+// -tempfile, -metric-key-prefix, -timeout, -output-format, -debug and -version.
+// Call Apply after parsing fs to configure MackerelPlugin.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.Tempfile, "tempfile", "", "Temp file name")
+	fs.StringVar(&f.MetricKeyPrefix, "metric-key-prefix", "", "Metric key prefix")
+	fs.DurationVar(&f.Timeout, "timeout", 0, "Timeout for fetching metrics (e.g. 10s)")
+	fs.StringVar(&f.OutputFormat, "output-format", "", "Output format: tsv, json, prometheus or graphite")
+	fs.BoolVar(&f.Debug, "debug", false, "Print how values are calculated without saving the state")
+	fs.BoolVar(&f.Version, "version", false, "Print version and exit")
+	return f
+}
+
+// Apply configures mp with the options.
+// Version is left to the plugin.
+func (f *Flags) Apply(mp *MackerelPlugin) error {
+	if f.Tempfile != "" {
+		mp.Tempfile = f.Tempfile
+	}
+	if f.MetricKeyPrefix != "" {
+		mp.Prefix = f.MetricKeyPrefix
+	}
+	if f.Timeout > 0 {
+		mp.Timeout = f.Timeout
+	}
+	if f.OutputFormat != "" {
+		formatter, err := FormatterByName(f.OutputFormat)
+		if err != nil {
+			return err
+		}
+		mp.Formatter = formatter
+	}
+	if f.Debug {
+		mp.Debug = true
+	}
+	return nil
+}
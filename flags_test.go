@@ -0,0 +1,67 @@
+package mackerelplugin
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestFlags(t *testing.T) {
+	fs := flag.NewFlagSet("mackerel-plugin-test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	optHost := fs.String("host", "localhost", "Hostname")
+	args := []string{"-tempfile", "/tmp/state", "-metric-key-prefix", "memcached", "-timeout", "3s", "-output-format", "json", "-debug", "-host", "example.com"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if *optHost != "example.com" {
+		t.Errorf("plugin specific flags should be parsed: %s", *optHost)
+	}
+	if flags.MetricKeyPrefix != "memcached" {
+		t.Errorf("MetricKeyPrefix = %q; want %q", flags.MetricKeyPrefix, "memcached")
+	}
+
+	mp := NewMackerelPlugin(testP{})
+	if err := flags.Apply(mp); err != nil {
+		t.Fatal(err)
+	}
+	if mp.Prefix != "memcached" {
+		t.Errorf("Prefix = %q; want %q", mp.Prefix, "memcached")
+	}
+	if mp.Tempfile != "/tmp/state" {
+		t.Errorf("Tempfile = %q; want %q", mp.Tempfile, "/tmp/state")
+	}
+	if mp.Timeout != 3*time.Second {
+		t.Errorf("Timeout = %v; want %v", mp.Timeout, 3*time.Second)
+	}
+	if mp.Formatter != (JSONLinesFormatter{}) {
+		t.Errorf("Formatter = %T; want JSONLinesFormatter", mp.Formatter)
+	}
+	if !mp.Debug {
+		t.Error("Debug should be true")
+	}
+}
+
+func TestFlagsKeepDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("mackerel-plugin-test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	mp := NewMackerelPlugin(testP{})
+	mp.SetTempfileByBasename("default-tempfile")
+	tempfile := mp.Tempfile
+	if err := flags.Apply(mp); err != nil {
+		t.Fatal(err)
+	}
+	if mp.Tempfile != tempfile || mp.Timeout != 0 || mp.Formatter != nil || mp.Debug || mp.Prefix != "" {
+		t.Errorf("Apply should not change unspecified options: %+v", mp)
+	}
+}
+
+func TestFlagsWithUnknownOutputFormat(t *testing.T) {
+	flags := &Flags{OutputFormat: "xml"}
+	if err := flags.Apply(NewMackerelPlugin(testP{})); err == nil {
+		t.Error("Apply should return an error for unknown formats")
+	}
+}
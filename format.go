@@ -0,0 +1,184 @@
+package mackerelplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter formats metric values and graph definitions to output
+type Formatter interface {
+	FormatValue(w io.Writer, key string, value Value, t time.Time) error
+	FormatDefinitions(w io.Writer, graphs map[string]Graphs) error
+}
+
+// FormatterByName returns the Formatter for name: "tsv", "json", "prometheus" or "graphite".
+func FormatterByName(name string) (Formatter, error) {
+	switch strings.ToLower(name) {
+	case "", "tsv":
+		return TSVFormatter{}, nil
+	case "json", "jsonl":
+		return JSONLinesFormatter{}, nil
+	case "prometheus":
+		return PrometheusFormatter{}, nil
+	case "graphite":
+		return GraphiteFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format: %q", name)
+}
+
+// setupFormatter sets Formatter from MACKEREL_PLUGIN_OUTPUT_FORMAT unless it is specified.
+func (mp *MackerelPlugin) setupFormatter() error {
+	if mp.Formatter != nil {
+		return nil
+	}
+	f, err := FormatterByName(os.Getenv("MACKEREL_PLUGIN_OUTPUT_FORMAT"))
+	if err != nil {
+		return err
+	}
+	mp.Formatter = f
+	return nil
+}
+
+func (mp *MackerelPlugin) formatter() Formatter {
+	if mp.Formatter == nil {
+		return TSVFormatter{}
+	}
+	return mp.Formatter
+}
+
+// TSVFormatter is the Formatter for mackerel-agent
+type TSVFormatter struct{}
+
+// FormatValue implements Formatter
+func (TSVFormatter) FormatValue(w io.Writer, key string, value Value, t time.Time) error {
+	_, err := fmt.Fprintf(w, "%s\t%s\t%d\n", key, formatTSVValue(value), t.Unix())
+	return err
+}
+
+// formatTSVValue formats integers exactly and other numbers with 6 decimal places.
+func formatTSVValue(v Value) string {
+	if v.kind != floatValue {
+		return v.String()
+	}
+	if v.f == math.Trunc(v.f) {
+		return strconv.FormatFloat(v.f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v.f, 'f', 6, 64)
+}
+
+// FormatDefinitions implements Formatter
+func (TSVFormatter) FormatDefinitions(w io.Writer, graphs map[string]Graphs) error {
+	b, err := json.Marshal(GraphDef{Graphs: graphs})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# mackerel-agent-plugin\n%s\n", b)
+	return err
+}
+
+// JSONLinesFormatter formats each value or graph as a JSON object in a line
+type JSONLinesFormatter struct{}
+
+// FormatValue implements Formatter
+func (JSONLinesFormatter) FormatValue(w io.Writer, key string, value Value, t time.Time) error {
+	return json.NewEncoder(w).Encode(struct {
+		Name  string      `json:"name"`
+		Value json.Number `json:"value"`
+		Time  int64       `json:"time"`
+	}{key, json.Number(value.String()), t.Unix()})
+}
+
+// FormatDefinitions implements Formatter
+func (JSONLinesFormatter) FormatDefinitions(w io.Writer, graphs map[string]Graphs) error {
+	enc := json.NewEncoder(w)
+	for _, k := range sortedKeys(graphs) {
+		err := enc.Encode(struct {
+			Name string `json:"name"`
+			Graphs
+		}{k, graphs[k]})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrometheusFormatter formats values in the Prometheus text exposition format.
+// Characters not allowed in Prometheus metric names are replaced with underscores.
+type PrometheusFormatter struct{}
+
+var prometheusNameReg = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+func prometheusName(key string) string {
+	name := prometheusNameReg.ReplaceAllString(key, "_")
+	if name != "" && isDigit(name[0]) {
+		name = "_" + name
+	}
+	return name
+}
+
+// FormatValue implements Formatter
+func (PrometheusFormatter) FormatValue(w io.Writer, key string, value Value, t time.Time) error {
+	_, err := fmt.Fprintf(w, "%s %s %d\n", prometheusName(key), value, t.UnixMilli())
+	return err
+}
+
+// FormatDefinitions implements Formatter.
+// It outputs HELP and TYPE lines for metrics without wildcards.
+func (PrometheusFormatter) FormatDefinitions(w io.Writer, graphs map[string]Graphs) error {
+	for _, k := range sortedKeys(graphs) {
+		g := graphs[k]
+		for _, m := range g.Metrics {
+			key := joinKey(k, m.Name)
+			if strings.ContainsAny(key, "*#") {
+				continue
+			}
+			if err := writePrometheusMetadata(w, prometheusName(key), g, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writePrometheusMetadata(w io.Writer, name string, g Graphs, m Metrics) error {
+	help := g.Label + ": " + m.Label
+	if g.Unit != "" {
+		help += " (" + g.Unit + ")"
+	}
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	return err
+}
+
+// GraphiteFormatter formats values in the Graphite plaintext protocol.
+// Graphite has no graph definitions, so FormatDefinitions outputs nothing.
+type GraphiteFormatter struct{}
+
+// FormatValue implements Formatter
+func (GraphiteFormatter) FormatValue(w io.Writer, key string, value Value, t time.Time) error {
+	_, err := fmt.Fprintf(w, "%s %s %d\n", key, value, t.Unix())
+	return err
+}
+
+// FormatDefinitions implements Formatter
+func (GraphiteFormatter) FormatDefinitions(w io.Writer, graphs map[string]Graphs) error {
+	return nil
+}
+
+func sortedKeys(graphs map[string]Graphs) []string {
+	keys := make([]string, 0, len(graphs))
+	for k := range graphs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
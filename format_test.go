@@ -0,0 +1,113 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFormatValue(t *testing.T) {
+	now := time.Unix(1437227240, 0)
+	tests := []struct {
+		f      Formatter
+		expect string
+	}{
+		{TSVFormatter{}, "foo.bar\t1.500000\t1437227240\nfoo.baz\t3\t1437227240\n"},
+		{JSONLinesFormatter{}, `{"name":"foo.bar","value":1.5,"time":1437227240}` + "\n" + `{"name":"foo.baz","value":3,"time":1437227240}` + "\n"},
+		{PrometheusFormatter{}, "foo_bar 1.5 1437227240000\nfoo_baz 3 1437227240000\n"},
+		{GraphiteFormatter{}, "foo.bar 1.5 1437227240\nfoo.baz 3 1437227240\n"},
+	}
+	for _, tt := range tests {
+		wtr := &bytes.Buffer{}
+		if err := tt.f.FormatValue(wtr, "foo.bar", Float(1.5), now); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.f.FormatValue(wtr, "foo.baz", Float(3), now); err != nil {
+			t.Fatal(err)
+		}
+		if got := wtr.String(); got != tt.expect {
+			t.Errorf("%T.FormatValue: got %q; want %q", tt.f, got, tt.expect)
+		}
+	}
+}
+
+func TestFormatDefinitions(t *testing.T) {
+	graphs := map[string]Graphs{
+		"memcached.cmd": {
+			Label: "Memcached Command",
+			Unit:  "integer",
+			Metrics: []Metrics{
+				{Name: "cmd_get", Label: "Get"},
+			},
+		},
+		"memcached.#": {
+			Label: "Memcached Slabs",
+			Unit:  "bytes",
+			Metrics: []Metrics{
+				{Name: "used", Label: "Used"},
+			},
+		},
+	}
+	tests := []struct {
+		f      Formatter
+		expect string
+	}{
+		{JSONLinesFormatter{}, `{"name":"memcached.#","label":"Memcached Slabs","unit":"bytes","metrics":[{"name":"used","label":"Used","stacked":false}]}` + "\n" +
+			`{"name":"memcached.cmd","label":"Memcached Command","unit":"integer","metrics":[{"name":"cmd_get","label":"Get","stacked":false}]}` + "\n"},
+		{PrometheusFormatter{}, "# HELP memcached_cmd_cmd_get Memcached Command: Get (integer)\n# TYPE memcached_cmd_cmd_get gauge\n"},
+		{GraphiteFormatter{}, ""},
+	}
+	for _, tt := range tests {
+		wtr := &bytes.Buffer{}
+		if err := tt.f.FormatDefinitions(wtr, graphs); err != nil {
+			t.Fatal(err)
+		}
+		if got := wtr.String(); got != tt.expect {
+			t.Errorf("%T.FormatDefinitions: got %q; want %q", tt.f, got, tt.expect)
+		}
+	}
+}
+
+func TestFormatterByName(t *testing.T) {
+	for name, want := range map[string]Formatter{
+		"":           TSVFormatter{},
+		"tsv":        TSVFormatter{},
+		"json":       JSONLinesFormatter{},
+		"Prometheus": PrometheusFormatter{},
+		"graphite":   GraphiteFormatter{},
+	} {
+		f, err := FormatterByName(name)
+		if err != nil {
+			t.Errorf("FormatterByName(%q): %v", name, err)
+		}
+		if f != want {
+			t.Errorf("FormatterByName(%q) = %T; want %T", name, f, want)
+		}
+	}
+	if _, err := FormatterByName("xml"); err == nil {
+		t.Error("FormatterByName should return an error for unknown formats")
+	}
+}
+
+func TestOutputValuesWithOutputFormatEnv(t *testing.T) {
+	t.Setenv("MACKEREL_PLUGIN_OUTPUT_FORMAT", "graphite")
+	var m testMemcachedPlugin
+	mp := NewMackerelPlugin(m)
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("memcached.cmd.cmd_get 11 %d\n", epoch)
+	if got := wtr.String(); got != expect {
+		t.Errorf("result of OutputValues is invalid :%s", got)
+	}
+
+	t.Setenv("MACKEREL_PLUGIN_OUTPUT_FORMAT", "xml")
+	mp = NewMackerelPlugin(m)
+	if err := mp.OutputValuesE(); err == nil {
+		t.Error("OutputValuesE should return an error for unknown formats")
+	}
+}
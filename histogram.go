@@ -0,0 +1,129 @@
+package mackerelplugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultPercentiles is the percentiles reported by Histogram unless Percentiles is specified
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// Histogram summarizes observations, such as latencies, into percentiles.
+// It is fed with raw observations by Observe or with counts of buckets by ObserveBucket,
+// and writes the percentiles and the count into the map of FetchMetrics by Fill.
+// The zero value is ready to use. It is safe for concurrent use.
+type Histogram struct {
+	// Percentiles to report, each in the range (0, 100].
+	Percentiles []float64
+
+	mu      sync.Mutex
+	buckets []histogramBucket
+	count   uint64
+}
+
+// histogramBucket holds count observations distributed uniformly in [lower, upper].
+// A raw observation is a bucket whose lower and upper are the same.
+type histogramBucket struct {
+	lower float64
+	upper float64
+	count uint64
+}
+
+// Observe adds an observation
+func (h *Histogram) Observe(v float64) {
+	h.ObserveBucket(v, v, 1)
+}
+
+// ObserveBucket adds count observations whose values are between lower and upper.
+// Counts are not cumulative; each bucket holds only its own observations.
+// Percentiles in the bucket are interpolated linearly.
+func (h *Histogram) ObserveBucket(lower float64, upper float64, count uint64) {
+	if count == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets = append(h.buckets, histogramBucket{lower: lower, upper: upper, count: count})
+	h.count += count
+}
+
+// Reset removes all observations
+func (h *Histogram) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets = nil
+	h.count = 0
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Percentile returns the p-th percentile of observations. It returns false if nothing is observed.
+func (h *Histogram) Percentile(p float64) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0, false
+	}
+	sort.SliceStable(h.buckets, func(i, j int) bool {
+		if h.buckets[i].upper != h.buckets[j].upper {
+			return h.buckets[i].upper < h.buckets[j].upper
+		}
+		return h.buckets[i].lower < h.buckets[j].lower
+	})
+
+	// the rank of the observation at the percentile, counted from 1
+	rank := p / 100 * float64(h.count)
+	var seen float64
+	for _, b := range h.buckets {
+		n := float64(b.count)
+		if seen+n >= rank {
+			return b.lower + (b.upper-b.lower)*(rank-seen)/n, true
+		}
+		seen += n
+	}
+	return h.buckets[len(h.buckets)-1].upper, true
+}
+
+func (h *Histogram) percentiles() []float64 {
+	if h.Percentiles == nil {
+		return DefaultPercentiles
+	}
+	return h.Percentiles
+}
+
+// percentileName returns the metric name of p-th percentile, such as "p99" or "p99_9".
+func percentileName(p float64) string {
+	return "p" + strings.ReplaceAll(strconv.FormatFloat(p, 'f', -1, 64), ".", "_")
+}
+
+// Fill writes the percentiles and the count of observations into stat with keys
+// such as "<key>.p50", "<key>.p99" and "<key>.count". Percentiles are not written
+// if nothing is observed. Graphs returns the graph definition for them.
+func (h *Histogram) Fill(stat map[string]float64, key string) {
+	for _, p := range h.percentiles() {
+		if v, ok := h.Percentile(p); ok {
+			stat[joinKey(key, percentileName(p))] = v
+		}
+	}
+	stat[joinKey(key, "count")] = float64(h.Count())
+}
+
+// Graphs returns the graph definition for the values written by Fill.
+// It should be defined with the same key as Fill, which may contain wildcards
+// to cover several histograms in one graph. Its metrics are Qualified.
+func (h *Histogram) Graphs(label string, unit string) Graphs {
+	g := Graphs{Label: label, Unit: unit}
+	for _, p := range h.percentiles() {
+		name := percentileName(p)
+		g.Metrics = append(g.Metrics, Metrics{Name: name, Label: strings.ToUpper(name[:1]) + name[1:], Qualified: true})
+	}
+	g.Metrics = append(g.Metrics, Metrics{Name: "count", Label: "Count", Qualified: true})
+	return g
+}
@@ -0,0 +1,246 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	var h Histogram
+	if _, ok := h.Percentile(50); ok {
+		t.Error("Percentile should return false if nothing is observed")
+	}
+	for _, v := range []float64{5, 1, 4, 2, 3} {
+		h.Observe(v)
+	}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{20, 1},
+		{50, 3},
+		{90, 5},
+		{100, 5},
+	}
+	for _, tt := range tests {
+		if got, _ := h.Percentile(tt.p); got != tt.want {
+			t.Errorf("Percentile(%v) = %v; want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestHistogramObserveBucket(t *testing.T) {
+	var h Histogram
+	h.ObserveBucket(0, 10, 50)
+	h.ObserveBucket(10, 100, 40)
+	h.ObserveBucket(100, 1000, 10)
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{10, 2},
+		{50, 10},
+		{70, 55},
+		{99, 910},
+	}
+	for _, tt := range tests {
+		if got, _ := h.Percentile(tt.p); got != tt.want {
+			t.Errorf("Percentile(%v) = %v; want %v", tt.p, got, tt.want)
+		}
+	}
+	if h.Count() != 100 {
+		t.Errorf("Count = %d; want 100", h.Count())
+	}
+	h.Reset()
+	if h.Count() != 0 {
+		t.Errorf("Count = %d after Reset; want 0", h.Count())
+	}
+}
+
+func TestHistogramFill(t *testing.T) {
+	h := Histogram{Percentiles: []float64{50, 99.9}}
+	stat := make(map[string]float64)
+	h.Fill(stat, "latency.api")
+	if want := map[string]float64{"latency.api.count": 0}; !reflect.DeepEqual(stat, want) {
+		t.Errorf("Fill = %v; want %v", stat, want)
+	}
+
+	h.Observe(10)
+	h.Observe(20)
+	h.Fill(stat, "latency.api")
+	want := map[string]float64{"latency.api.p50": 10, "latency.api.p99_9": 20, "latency.api.count": 2}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("Fill = %v; want %v", stat, want)
+	}
+
+	g := h.Graphs("Latency", UnitMilliseconds)
+	var names []string
+	for _, m := range g.Metrics {
+		names = append(names, m.Name)
+	}
+	if want := []string{"p50", "p99_9", "count"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Graphs has metrics %v; want %v", names, want)
+	}
+}
+
+type testPHistogram struct {
+	api   *Histogram
+	query *Histogram
+}
+
+func (t testPHistogram) FetchMetrics() (map[string]float64, error) {
+	stat := make(map[string]float64)
+	t.api.Fill(stat, "latency.api")
+	t.query.Fill(stat, "query")
+	return stat, nil
+}
+
+func (t testPHistogram) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"latency.#": t.api.Graphs("Latency", UnitMilliseconds),
+		"query":     t.query.Graphs("Query", UnitMilliseconds),
+	}
+}
+
+func TestOutputValuesWithHistogram(t *testing.T) {
+	p := testPHistogram{api: &Histogram{Percentiles: []float64{50}}, query: &Histogram{Percentiles: []float64{50}}}
+	p.api.Observe(15)
+	p.query.Observe(30)
+	mp := NewMackerelPlugin(p)
+	if problems := mp.Validate(); problems != nil {
+		t.Errorf("Validate = %q; want nil", problems)
+	}
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("latency.api.p50\t15\t%[1]d\n"+
+		"latency.api.count\t1\t%[1]d\n"+
+		"query.p50\t30\t%[1]d\n"+
+		"query.count\t1\t%[1]d\n", epoch)
+	if got := wtr.String(); sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid:\n%s", got)
+	}
+}
+
+type testPHistogramWithCount struct {
+	latency *Histogram
+	key     string
+}
+
+func (t testPHistogramWithCount) FetchMetrics() (map[string]float64, error) {
+	stat := map[string]float64{"count": 42}
+	t.latency.Fill(stat, t.key)
+	return stat, nil
+}
+
+func (t testPHistogramWithCount) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"conn": {
+			Metrics: []Metrics{
+				{Name: "count"},
+			},
+		},
+		t.key: t.latency.Graphs("Latency", UnitMilliseconds),
+	}
+}
+
+func newTestPHistogramWithCount(key string) testPHistogramWithCount {
+	p := testPHistogramWithCount{latency: &Histogram{Percentiles: []float64{50}}, key: key}
+	for i := 1; i <= 100; i++ {
+		p.latency.Observe(float64(i))
+	}
+	return p
+}
+
+func TestOutputValuesWithHistogramAndSameName(t *testing.T) {
+	mp := NewMackerelPlugin(newTestPHistogramWithCount("latency"))
+	if problems := mp.Validate(); problems != nil {
+		t.Errorf("Validate = %q; want nil", problems)
+	}
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("conn.count\t42\t%[1]d\n"+
+		"latency.p50\t50\t%[1]d\n"+
+		"latency.count\t100\t%[1]d\n", epoch)
+	if got := wtr.String(); sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid:\n%s", got)
+	}
+
+	// Fill without a key writes "count", which is also read by graph "conn".
+	mp = NewMackerelPlugin(newTestPHistogramWithCount(""))
+	want := []Problem{{"conn", "count", `duplicate metric name; also defined in graph ""`}}
+	if got := mp.Validate(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate = %q; want %q", got, want)
+	}
+}
+
+func TestHistogramWithCompositePlugin(t *testing.T) {
+	c, err := NewCompositePlugin(newTestPHistogramWithCount("latency"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := c.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"conn.count": 42, "latency.p50": 50, "latency.count": 100}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics = %v; want %v", stat, want)
+	}
+}
+
+func TestHistogramWithMultiInstancePlugin(t *testing.T) {
+	m := newTestMultiInstancePlugin(t, map[string]Plugin{"a": newTestPHistogramWithCount("latency")})
+	stat, err := m.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"conn.a.count": 42, "latency.a.p50": 50, "latency.a.count": 100}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics = %v; want %v", stat, want)
+	}
+}
+
+type testPHistogramWithMax struct {
+	latency *Histogram
+}
+
+func (t testPHistogramWithMax) FetchMetrics() (map[string]float64, error) {
+	stat := map[string]float64{"max": 1, "latency.max": 100}
+	t.latency.Fill(stat, "latency")
+	return stat, nil
+}
+
+func (t testPHistogramWithMax) GraphDefinition() map[string]Graphs {
+	g := t.latency.Graphs("Latency", UnitMilliseconds)
+	g.Metrics = append(g.Metrics, Metrics{Name: "max", Label: "Max", Qualified: true})
+	return map[string]Graphs{"latency": g}
+}
+
+func TestOutputValuesWithHistogramAndQualifiedMetric(t *testing.T) {
+	p := testPHistogramWithMax{latency: &Histogram{Percentiles: []float64{50}}}
+	p.latency.Observe(30)
+	mp := NewMackerelPlugin(p)
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("latency.p50\t30\t%[1]d\n"+
+		"latency.count\t1\t%[1]d\n"+
+		"latency.max\t100\t%[1]d\n", epoch)
+	if got := wtr.String(); sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid:\n%s", got)
+	}
+}
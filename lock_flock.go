@@ -0,0 +1,37 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mackerelplugin
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func lockFile(path string, wait bool) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close() // nolint
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrStateLocked
+		}
+		return nil, err
+	}
+	return func() error {
+		defer f.Close() // nolint
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}, nil
+}
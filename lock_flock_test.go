@@ -0,0 +1,61 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mackerelplugin
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputValuesWhileLocked(t *testing.T) {
+	store := &FileStateStore{Path: filepath.Join(t.TempDir(), "state")}
+	unlock, err := store.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock() // nolint
+
+	if _, err := store.Lock(false); !errors.Is(err, ErrStateLocked) {
+		t.Errorf("Lock: %v; want %v", err, ErrStateLocked)
+	}
+
+	tests := []struct {
+		mode LockMode
+		err  error
+	}{
+		{LockSkip, nil},
+		{LockFail, ErrStateLocked},
+	}
+	for _, tt := range tests {
+		var n int
+		mp := NewMackerelPlugin(testPCounter{n: &n, cancel: func() {}})
+		mp.StateStore = store
+		mp.LockMode = tt.mode
+		wtr := &bytes.Buffer{}
+		mp.Writer = wtr
+		if err := mp.OutputValuesE(); !errors.Is(err, tt.err) {
+			t.Errorf("OutputValuesE with LockMode %d: %v; want %v", tt.mode, err, tt.err)
+		}
+		if n != 0 || wtr.Len() != 0 {
+			t.Errorf("OutputValuesE with LockMode %d should not output anything: %q", tt.mode, wtr.String())
+		}
+	}
+}
+
+func TestFileStateStoreUnlock(t *testing.T) {
+	store := &FileStateStore{Path: filepath.Join(t.TempDir(), "state")}
+	unlock, err := store.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = store.Lock(false)
+	if err != nil {
+		t.Fatalf("Lock after unlock: %v", err)
+	}
+	unlock() // nolint
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package mackerelplugin
+
+// lockFile does nothing on platforms without flock(2).
+func lockFile(path string, wait bool) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,60 @@
+package mackerelplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RunLoop outputs the metrics every interval until ctx is done.
+// Unlike Run, it keeps last values in memory to calculate differentials.
+// If Checkpoint is true, last values are also loaded from and saved to Tempfile,
+// so that counters survive restarts.
+// If the plugin does not implement PluginWithContext and a fetch times out, the next fetches are skipped
+// until the abandoned one returns.
+func (mp *MackerelPlugin) RunLoop(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("non-positive interval for RunLoop: %v", interval)
+	}
+	if err := mp.setupFormatter(); err != nil {
+		return err
+	}
+	var last *State
+	if mp.Checkpoint {
+		var err error
+		last, err = mp.fetchLastValues(mp.now())
+		if err != nil && err != errStateRecentlyUpdated {
+			mp.logger().Println("fetchLastValues (ignore):", err)
+		}
+	}
+
+	var f fetcher
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		now := mp.now()
+		stat, err := mp.fetchStat(ctx, &f)
+		var pe *PartialError
+		if err != nil {
+			mp.logger().Println("RunLoop:", err)
+		}
+		if err == nil || errors.As(err, &pe) {
+			if err := mp.writeValues(stat, last, now); err != nil {
+				return err
+			}
+			last = mp.nextState(stat, last, now)
+			if mp.Checkpoint && !mp.debugEnabled() {
+				if err := mp.saveValues(last); err != nil {
+					mp.logger().Println("RunLoop:", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
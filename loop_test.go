@@ -0,0 +1,98 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPCounter struct {
+	n      *int
+	cancel context.CancelFunc
+}
+
+func (t testPCounter) FetchMetrics() (map[string]float64, error) {
+	*t.n++
+	if *t.n >= 2 {
+		time.AfterFunc(10*time.Millisecond, t.cancel)
+	}
+	return map[string]float64{
+		"count": float64(*t.n),
+		"gauge": 10,
+	}, nil
+}
+
+func (t testPCounter) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"counter": {
+			Metrics: []Metrics{
+				{Name: "count", Diff: true},
+				{Name: "gauge"},
+			},
+		},
+	}
+}
+
+func TestRunLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var n int
+	mp := NewMackerelPlugin(testPCounter{n: &n, cancel: cancel})
+	mp.Tempfile = "state_file_should_not_exist.json"
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.RunLoop(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("FetchMetrics was called %d times; want 2", n)
+	}
+
+	lines := strings.Split(strings.TrimSpace(wtr.String()), "\n")
+	var gauges, counts int
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "counter.gauge\t10\t"):
+			gauges++
+		case strings.HasPrefix(line, "counter.count\t"):
+			counts++
+		default:
+			t.Errorf("unexpected line: %q", line)
+		}
+	}
+	if gauges != 2 || counts != 1 {
+		t.Errorf("RunLoop should output gauge twice and differential once: %q", wtr.String())
+	}
+}
+
+func TestRunLoopWithCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := 1
+	mp := NewMackerelPlugin(testPCounter{n: &n, cancel: cancel})
+	mp.Tempfile = t.TempDir() + "/state"
+	mp.Checkpoint = true
+	mp.Writer = &bytes.Buffer{}
+	if err := mp.RunLoop(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	last, err := mp.fetchLastValues(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || last.Values["count"] != Float(2) {
+		t.Errorf("checkpoint should save last values: %v", last)
+	}
+}
+
+func TestRunLoopWithNonPositiveInterval(t *testing.T) {
+	mp := NewMackerelPlugin(testP{})
+	mp.Writer = &bytes.Buffer{}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := mp.RunLoop(context.Background(), interval); err == nil {
+			t.Errorf("RunLoop with interval %v should return an error", interval)
+		}
+	}
+}
@@ -1,17 +1,17 @@
 package mackerelplugin
 
 import (
+	"context"
 	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/text/cases"
@@ -40,8 +40,35 @@ type Metrics struct {
 	Diff    bool    `json:"-"`
 	Stacked bool    `json:"stacked"`
 	Scale   float64 `json:"-"`
+	// DiffMode specifies how differentials are normalized when Diff is true.
+	DiffMode DiffMode `json:"-"`
+	// Expr is an expression to derive the value from other metrics in the same graph,
+	// such as "get_hits / (get_hits + get_misses) * 100". The values of the other metrics
+	// are the ones after calculating differentials and scaling.
+	Expr string `json:"-"`
+
+	// CounterBits is the bit width of the counter, 32 or 64.
+	// If it is set, the wraparound of the counter is corrected when calculating differentials.
+	CounterBits int `json:"-"`
+	// ResetAsZero treats a decreased counter as restarted from zero instead of skipping it.
+	ResetAsZero bool `json:"-"`
+	// MaxInterval is the longest interval to calculate differentials. Zero means 10 minutes.
+	MaxInterval time.Duration `json:"-"`
+	// Qualified reads the value from the key "<graph key>.<name>" of FetchMetrics instead of the name,
+	// so that the same metric names in different graphs never collide. Histogram.Graphs sets it.
+	Qualified bool `json:"-"`
 }
 
+// DiffMode specifies how differentials of counters are normalized
+type DiffMode int
+
+// Diff modes
+const (
+	DiffPerMinute DiffMode = iota // increase per minute
+	DiffPerSecond                 // increase per second
+	DiffDelta                     // increase since the last fetch
+)
+
 // Graphs represents definition of a graph
 type Graphs struct {
 	Label   string    `json:"label"`
@@ -61,12 +88,64 @@ type PluginWithPrefix interface {
 	MetricKeyPrefix() string
 }
 
+// PluginWithContext is an interface for plugins which can abort fetching metrics.
+// FetchMetricsContext may return metrics collected so far along with ctx.Err()
+// when ctx is done; they are output as partial results.
+type PluginWithContext interface {
+	Plugin
+	FetchMetricsContext(ctx context.Context) (map[string]float64, error)
+}
+
+// PluginWithValues is an interface for plugins which fetch 64-bit integers without losing precision.
+// If it is implemented, FetchMetricValues is used instead of FetchMetrics and FetchMetricsContext,
+// and differentials of integers are calculated in integer arithmetic.
+type PluginWithValues interface {
+	Plugin
+	FetchMetricValues(ctx context.Context) (map[string]Value, error)
+}
+
 // MackerelPlugin is for mackerel-agent-plugins
 type MackerelPlugin struct {
 	Plugin
 	Tempfile string
-	diff     *bool
-	writer   io.Writer
+	// Prefix is the prefix of metric keys, which may consist of several segments like "app.memcached".
+	// If it is specified, it overrides MetricKeyPrefix of the plugin.
+	Prefix string
+	// Timeout limits the duration of fetching metrics. Zero means no timeout.
+	Timeout time.Duration
+	// StateStore stores last values. If it is nil, they are stored into Tempfile.
+	StateStore StateStore
+	// Formatter formats the output. If it is nil, the format is chosen by
+	// MACKEREL_PLUGIN_OUTPUT_FORMAT environment variable; the default is TSVFormatter.
+	Formatter Formatter
+	// Diagnostics makes OutputValues log fetched keys which are not defined in graph definitions
+	// and defined metrics which are not fetched. It is also enabled by MACKEREL_PLUGIN_DIAGNOSTICS.
+	Diagnostics bool
+	// Debug makes OutputValues print raw values, last values, elapsed seconds, differentials,
+	// scales and output values side by side instead of metrics, without saving the state.
+	// It is also enabled by MACKEREL_PLUGIN_DEBUG.
+	Debug bool
+	// LockMode specifies the behavior when the state is locked by another process.
+	LockMode LockMode
+	// Checkpoint makes RunLoop save last values to StateStore on every interval.
+	Checkpoint bool
+	// StateRetention keeps last values of metrics missing from the current fetch in the state
+	// until the duration passes since they were fetched last, so that differentials are calculated
+	// when they appear again. If it is zero, they are dropped immediately.
+	StateRetention time.Duration
+	// Writer is where values and graph definitions are output. If it is nil, os.Stdout is used.
+	Writer io.Writer
+	// Clock tells the current time used for the output and differentials.
+	// If it is nil, the system clock is used.
+	Clock Clock
+	// Logger logs errors and diagnostics. If it is nil, the standard logger of package log is used.
+	Logger *log.Logger
+	diff   *bool
+}
+
+// Clock tells the current time. It can be replaced to simulate the passage of time in tests.
+type Clock interface {
+	Now() time.Time
 }
 
 // NewMackerelPlugin returns new MackrelPlugin
@@ -75,10 +154,24 @@ func NewMackerelPlugin(plugin Plugin) *MackerelPlugin {
 }
 
 func (mp *MackerelPlugin) getWriter() io.Writer {
-	if mp.writer == nil {
-		mp.writer = os.Stdout
+	if mp.Writer == nil {
+		return os.Stdout
+	}
+	return mp.Writer
+}
+
+func (mp *MackerelPlugin) now() time.Time {
+	if mp.Clock == nil {
+		return time.Now()
 	}
-	return mp.writer
+	return mp.Clock.Now()
+}
+
+func (mp *MackerelPlugin) logger() *log.Logger {
+	if mp.Logger == nil {
+		return log.Default()
+	}
+	return mp.Logger
 }
 
 func (mp *MackerelPlugin) hasDiff() bool {
@@ -98,91 +191,140 @@ func (mp *MackerelPlugin) hasDiff() bool {
 	return *mp.diff
 }
 
-func (mp *MackerelPlugin) printValue(w io.Writer, key string, value float64, now time.Time) {
-	if math.IsNaN(value) || math.IsInf(value, 0) {
-		log.Printf("Invalid value: key = %s, value = %f\n", key, value)
+func (mp *MackerelPlugin) printValue(w io.Writer, key string, value Value, now time.Time) {
+	if !value.isFinite() {
+		mp.logger().Printf("Invalid value: key = %s, value = %v\n", key, value)
 		return
 	}
-
-	if value == float64(int(value)) {
-		fmt.Fprintf(w, "%s\t%d\t%d\n", key, int(value), now.Unix()) // nolint
-	} else {
-		fmt.Fprintf(w, "%s\t%f\t%d\n", key, value, now.Unix()) // nolint
-	}
+	mp.formatter().FormatValue(w, key, value, now) // nolint
 }
 
 var errStateRecentlyUpdated = errors.New("state was recently updated")
 
 const oldEnoughDuration = time.Second
 
-func (mp *MackerelPlugin) fetchLastValues(now time.Time) (map[string]float64, time.Time, error) {
-	if !mp.hasDiff() {
-		return nil, time.Time{}, nil
+func (mp *MackerelPlugin) stateStore() StateStore {
+	if mp.StateStore != nil {
+		return mp.StateStore
 	}
+	return &FileStateStore{Path: mp.tempfilename()}
+}
 
-	f, err := os.Open(mp.tempfilename())
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, time.Time{}, nil
-		}
-		return nil, time.Time{}, err
-	}
-	defer f.Close() // nolint
-
-	stat := make(map[string]float64)
-	decoder := json.NewDecoder(f)
-	err = decoder.Decode(&stat)
-	if err != nil {
-		return stat, time.Time{}, err
+// lockState locks the state store exclusively if it supports locking.
+func (mp *MackerelPlugin) lockState() (func() error, error) {
+	l, ok := mp.stateStore().(StateLocker)
+	if !ok || !mp.hasDiff() {
+		return func() error { return nil }, nil
 	}
-	lastTime := time.Unix(int64(stat["_lastTime"]), 0)
-	if now.Sub(lastTime) < oldEnoughDuration {
-		return stat, time.Time{}, errStateRecentlyUpdated
-	}
-	return stat, lastTime, nil
+	return l.Lock(mp.LockMode == LockWait)
 }
 
-func (mp *MackerelPlugin) saveValues(values map[string]float64, now time.Time) error {
+// fetchLastValues loads the state saved last. It returns nil State if nothing has been saved.
+func (mp *MackerelPlugin) fetchLastValues(now time.Time) (*State, error) {
 	if !mp.hasDiff() {
-		return nil
+		return nil, nil
 	}
-	f, err := os.Create(mp.tempfilename())
+
+	state, err := mp.stateStore().Load()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if state == nil {
+		return nil, nil
 	}
-	defer f.Close() // nolint
+	if state.Prefix != "" && state.Prefix != mp.metricKeyPrefix() {
+		mp.logger().Printf("fetchLastValues: ignore the state saved with another prefix %q\n", state.Prefix)
+		return nil, nil
+	}
+	if now.Sub(state.Time) < oldEnoughDuration {
+		return nil, errStateRecentlyUpdated
+	}
+	return state, nil
+}
 
+// nextState returns the state to be used at the next run.
+// Values of last which are missing from values are carried forward for StateRetention.
+func (mp *MackerelPlugin) nextState(values map[string]Value, last *State, now time.Time) *State {
+	state := &State{
+		Values:   make(map[string]Value, len(values)),
+		Time:     now,
+		LastSeen: make(map[string]time.Time, len(values)),
+		Prefix:   mp.metricKeyPrefix(),
+	}
 	// Since Go 1.15 strconv.ParseFloat returns +Inf if it couldn't parse a string.
 	// But JSON does not accept invalid numbers, such as +Inf, -Inf or NaN.
 	// We perhaps have some plugins that is affected above change,
 	// so saveState should clear invalid numbers in the values before saving it.
 	for k, v := range values {
-		if math.IsInf(v, 0) || math.IsNaN(v) {
-			delete(values, k)
+		if !v.isFinite() {
+			continue
+		}
+		state.Values[k] = v.At(time.Time{})
+		state.LastSeen[k] = v.timeOr(now)
+	}
+	if mp.StateRetention <= 0 || last == nil {
+		return state
+	}
+	for k, v := range last.Values {
+		if _, ok := values[k]; ok {
+			continue
+		}
+		_, t, _ := last.lookup(k)
+		if now.Sub(t) > mp.StateRetention {
+			continue
 		}
+		state.Values[k] = v
+		state.LastSeen[k] = t
 	}
+	return state
+}
 
-	values["_lastTime"] = float64(now.Unix())
-	encoder := json.NewEncoder(f)
-	err = encoder.Encode(values)
-	if err != nil {
-		return err
+func (mp *MackerelPlugin) saveValues(state *State) error {
+	if !mp.hasDiff() {
+		return nil
 	}
+	return mp.stateStore().Save(state)
+}
 
-	return nil
+// metricKeyPrefix returns Prefix if specified, otherwise MetricKeyPrefix of the plugin.
+// It returns empty string if metric keys have no prefix.
+func (mp *MackerelPlugin) metricKeyPrefix() string {
+	if mp.Prefix != "" {
+		return mp.Prefix
+	}
+	if p, ok := mp.Plugin.(PluginWithPrefix); ok {
+		return p.MetricKeyPrefix()
+	}
+	return ""
 }
 
-func (mp *MackerelPlugin) calcDiff(value float64, now time.Time, lastValue float64, lastTime time.Time) (float64, error) {
-	diffTime := now.Unix() - lastTime.Unix()
-	if diffTime > 600 {
-		return 0, errors.New("too long duration")
+const defaultMaxInterval = 600 * time.Second
+
+func (mp *MackerelPlugin) calcDiff(metric Metrics, value Value, now time.Time, lastValue Value, lastTime time.Time) (Value, error) {
+	elapsed := now.Sub(lastTime)
+	maxInterval := metric.MaxInterval
+	if maxInterval == 0 {
+		maxInterval = defaultMaxInterval
+	}
+	if elapsed > maxInterval {
+		return Value{}, errors.New("too long duration")
+	}
+	if elapsed <= 0 {
+		return Value{}, errors.New("too short duration")
 	}
 
-	diff := (value - lastValue) * 60 / float64(diffTime)
-	if diff < 0 {
-		return 0, errors.New("counter seems to be reset")
+	delta, err := counterDelta(metric, value, lastValue)
+	if err != nil {
+		return Value{}, err
+	}
+	switch metric.DiffMode {
+	case DiffPerSecond:
+		return Float(delta.Float64() / elapsed.Seconds()), nil
+	case DiffDelta:
+		return delta, nil
+	default:
+		return Float(delta.Float64() * 60 / elapsed.Seconds()), nil
 	}
-	return diff, nil
 }
 
 func (mp *MackerelPlugin) tempfilename() string {
@@ -201,10 +343,8 @@ func (mp *MackerelPlugin) SetTempfileByBasename(base string) {
 
 func (mp *MackerelPlugin) generateTempfilePath(args []string) string {
 	commandPath := args[0]
-	var prefix string
-	if p, ok := mp.Plugin.(PluginWithPrefix); ok {
-		prefix = p.MetricKeyPrefix()
-	} else {
+	prefix := tempfileSanitizeReg.ReplaceAllString(mp.metricKeyPrefix(), "_")
+	if prefix == "" {
 		name := filepath.Base(commandPath)
 		prefix = strings.TrimPrefix(tempfileSanitizeReg.ReplaceAllString(name, "_"), "mackerel-plugin-")
 	}
@@ -218,90 +358,347 @@ func (mp *MackerelPlugin) generateTempfilePath(args []string) string {
 	return filepath.Join(pluginutil.PluginWorkDir(), filename)
 }
 
+func (mp *MackerelPlugin) fetchMetrics(ctx context.Context, f *fetcher) (map[string]Value, error) {
+	if mp.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mp.Timeout)
+		defer cancel()
+	}
+	return fetchMetricsContext(ctx, mp.Plugin, f)
+}
+
+// fetcher tracks FetchMetrics of a plugin which does not know ctx and has been abandoned.
+type fetcher struct {
+	running atomic.Bool
+}
+
+var errFetchRunning = errors.New("the last fetch is still running")
+
+// fetchMetricsContext fetches metrics from p until ctx is done.
+// If p does not know ctx, it stops waiting for FetchMetrics instead, which keeps running.
+// Long-running modes pass f so that another FetchMetrics is not started until it returns;
+// otherwise a hung backend leaks a goroutine and a connection on every interval.
+func fetchMetricsContext(ctx context.Context, p Plugin, f *fetcher) (map[string]Value, error) {
+	if p, ok := p.(PluginWithValues); ok {
+		return p.FetchMetricValues(ctx)
+	}
+	if p, ok := p.(PluginWithContext); ok {
+		stat, err := p.FetchMetricsContext(ctx)
+		return floatValues(stat), err
+	}
+	if ctx.Done() == nil {
+		stat, err := p.FetchMetrics()
+		return floatValues(stat), err
+	}
+
+	// The plugin does not know ctx, so we stop waiting for it instead.
+	if f != nil && !f.running.CompareAndSwap(false, true) {
+		return nil, errFetchRunning
+	}
+	type result struct {
+		stat map[string]float64
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		stat, err := p.FetchMetrics()
+		if f != nil {
+			f.running.Store(false)
+		}
+		c <- result{stat, err}
+	}()
+	select {
+	case r := <-c:
+		return floatValues(r.stat), r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // OutputValues output the metrics
 func (mp *MackerelPlugin) OutputValues() {
-	now := time.Now()
-	stat, err := mp.FetchMetrics()
+	if err := mp.OutputValuesE(); err != nil {
+		mp.exitWithError(err, "OutputValues: ")
+	}
+}
+
+// OutputValuesE outputs the metrics like OutputValues, but returns an error instead of exiting.
+func (mp *MackerelPlugin) OutputValuesE() error {
+	return mp.outputValues(context.Background())
+}
+
+func (mp *MackerelPlugin) outputValues(ctx context.Context) error {
+	if err := mp.setupFormatter(); err != nil {
+		return err
+	}
+	unlock, err := mp.lockState()
 	if err != nil {
-		log.Fatalln("OutputValues: ", err)
+		if mp.LockMode == LockSkip && errors.Is(err, ErrStateLocked) {
+			mp.logger().Println("OutputValues:", err)
+			return nil
+		}
+		return err
+	}
+	defer unlock() // nolint
+
+	now := mp.now()
+	stat, fetchErr := mp.fetchStat(ctx, nil)
+	var pe *PartialError
+	if fetchErr != nil && !errors.As(fetchErr, &pe) {
+		return fetchErr
+	}
+	if mp.diagnosticsEnabled() {
+		mp.logDiagnosis(stat)
 	}
 
-	lastStat, lastTime, err := mp.fetchLastValues(now)
+	last, err := mp.fetchLastValues(now)
 	if err != nil {
 		if err == errStateRecentlyUpdated {
-			log.Println("OutputValues:", err)
-			return
+			mp.logger().Println("OutputValues:", err)
+			return fetchErr
 		}
-		log.Println("fetchLastValues (ignore):", err)
+		mp.logger().Println("fetchLastValues (ignore):", err)
 	}
 
+	if err := mp.writeValues(stat, last, now); err != nil {
+		return err
+	}
+	if mp.debugEnabled() {
+		// Debug mode is a dry run; it must not affect the next run.
+		return fetchErr
+	}
+	// Only the values fetched are saved in case of a PartialError.
+	if err := mp.saveValues(mp.nextState(stat, last, now)); err != nil {
+		return err
+	}
+	return fetchErr
+}
+
+// fetchStat returns a PartialError along with the values fetched
+// if the plugin returns one or times out after fetching some values.
+func (mp *MackerelPlugin) fetchStat(ctx context.Context, f *fetcher) (map[string]Value, error) {
+	stat, err := mp.fetchMetrics(ctx, f)
+	if err != nil {
+		var pe *PartialError
+		if len(stat) == 0 || !(errors.As(err, &pe) || isTimeout(err)) {
+			return nil, &FetchError{Err: err}
+		}
+		if pe != nil {
+			return stat, err
+		}
+		return stat, &PartialError{Err: err}
+	}
+	return stat, nil
+}
+
+func (mp *MackerelPlugin) writeValues(stat map[string]Value, last *State, now time.Time) error {
+	if mp.debugEnabled() {
+		mp.printDebugHeader()
+	}
 	for key, graph := range mp.GraphDefinition() {
+		// values holds output values keyed by keys of stat for derived metrics.
+		values := make(map[string]float64)
 		for _, metric := range graph.Metrics {
+			if metric.Expr != "" {
+				continue
+			}
 			if strings.ContainsAny(key+metric.Name, "*#") {
-				mp.formatValuesWithWildcard(key, metric, stat, lastStat, now, lastTime)
-			} else {
-				mp.formatValues(key, metric, stat, lastStat, now, lastTime)
+				vs, err := mp.formatValuesWithWildcard(key, metric, stat, last, now)
+				if err != nil {
+					return err
+				}
+				for k, v := range vs {
+					values[k] = v
+				}
+			} else if v, ok := mp.formatValues(key, metric, stat, last, now); ok {
+				values[metric.Name] = v.Float64()
 			}
 		}
+		if err := mp.formatDerivedValues(key, graph, values, now); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err = mp.saveValues(stat, now)
-	if err != nil {
-		log.Fatalf("saveValues: %s", err)
-	}
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// wildcardPattern converts a metric key containing wildcards into a regular expression.
+func wildcardPattern(key string) string {
+	s := strings.ReplaceAll(key, ".", `\.`)
+	s = strings.ReplaceAll(s, "*", `[-a-zA-Z0-9_]+`)
+	s = strings.ReplaceAll(s, "#", `[-a-zA-Z0-9_]+`)
+	return s
 }
 
-func (mp *MackerelPlugin) formatValuesWithWildcard(prefix string, metric Metrics, stat map[string]float64, lastStat map[string]float64, now time.Time, lastTime time.Time) {
-	regexpStr := `\A` + prefix + "." + metric.Name
-	regexpStr = strings.ReplaceAll(regexpStr, ".", `\.`)
-	regexpStr = strings.ReplaceAll(regexpStr, "*", `[-a-zA-Z0-9_]+`)
-	regexpStr = strings.ReplaceAll(regexpStr, "#", `[-a-zA-Z0-9_]+`)
-	re, err := regexp.Compile(regexpStr)
+func (mp *MackerelPlugin) formatValuesWithWildcard(prefix string, metric Metrics, stat map[string]Value, last *State, now time.Time) (map[string]float64, error) {
+	re, err := regexp.Compile(`\A` + wildcardPattern(prefix+"."+metric.Name))
 	if err != nil {
-		log.Fatalln("Failed to compile regexp: ", err)
+		return nil, &DefinitionError{Key: prefix, Metric: metric.Name, Err: err}
 	}
+	values := make(map[string]float64)
 	for k := range stat {
 		if re.MatchString(k) {
 			metricEach := metric
 			metricEach.Name = k
-			mp.formatValues("", metricEach, stat, lastStat, now, lastTime)
+			if v, ok := mp.formatValues("", metricEach, stat, last, now); ok {
+				values[k] = v.Float64()
+			}
 		}
 	}
+	return values, nil
 }
 
-func (mp *MackerelPlugin) formatValues(prefix string, metric Metrics, stat map[string]float64, lastStat map[string]float64, now time.Time, lastTime time.Time) {
-	name := metric.Name
-	value, ok := stat[name]
+func (mp *MackerelPlugin) formatValues(prefix string, metric Metrics, stat map[string]Value, last *State, now time.Time) (Value, bool) {
+	name, value, ok := lookupValue(stat, prefix, metric, usesQualifiedKeys(mp.Plugin))
 	if !ok {
-		return
+		return Value{}, false
+	}
+	key := mp.metricKey(prefix, metric.Name)
+	// The value is output at the time it was sampled if the plugin tells.
+	t := value.timeOr(now)
+	var dbg *debugRow
+	if mp.debugEnabled() {
+		dbg = newDebugRow(key, value.String(), metric)
+		defer mp.printDebugRow(dbg)
 	}
 	if metric.Diff {
-		lastValue, ok := lastStat[name]
+		lastValue, lastTime, ok := last.lookup(name)
 		if ok {
 			var err error
-			value, err = mp.calcDiff(value, now, lastValue, lastTime)
+			value, err = mp.calcDiff(metric, value, t, lastValue, lastTime)
+			if dbg != nil {
+				dbg.setDiff(lastValue, t, lastTime, value, err)
+			}
 			if err != nil {
-				log.Println("OutputValues: ", err)
+				mp.logger().Printf("OutputValues: %s: %v\n", name, err)
+				return Value{}, false
 			}
 		} else {
-			log.Printf("%s does not exist at last fetch\n", metric.Name)
-			return
+			if dbg != nil {
+				dbg.diff = "error: does not exist at last fetch"
+			}
+			mp.logger().Printf("%s does not exist at last fetch\n", metric.Name)
+			return Value{}, false
 		}
 	}
 
+	if metric.Scale != 0 {
+		value = Float(value.Float64() * metric.Scale)
+	}
+
+	if dbg != nil {
+		dbg.value = value.String()
+	} else {
+		mp.printValue(mp.getWriter(), key, value, t)
+	}
+	return value, true
+}
+
+// usesQualifiedKeys tells whether p keys all values with their graph keys, such as CompositePlugin.
+func usesQualifiedKeys(p Plugin) bool {
+	q, ok := p.(interface{ usesQualifiedKeys() bool })
+	return ok && q.usesQualifiedKeys()
+}
+
+// lookupValue returns the value of metric in graph key and the key of stat where it is found.
+// The value is keyed with the metric name, or with the graph key and the metric name
+// if qualified or metric.Qualified is true.
+func lookupValue(stat map[string]Value, key string, metric Metrics, qualified bool) (string, Value, bool) {
+	name := metric.Name
+	if qualified || metric.Qualified {
+		name = joinKey(key, metric.Name)
+	}
+	v, ok := stat[name]
+	return name, v, ok
+}
+
+// formatDerivedValues evaluates expressions of derived metrics in graph with values of other metrics.
+// For graphs with wildcards, expressions are evaluated for each expanded graph key.
+func (mp *MackerelPlugin) formatDerivedValues(key string, graph Graphs, values map[string]float64, now time.Time) error {
+	var instances []string
+	wildcard := strings.ContainsAny(key, "*#")
+	if wildcard {
+		re, err := regexp.Compile(`\A` + wildcardPattern(key) + `\z`)
+		if err != nil {
+			return &DefinitionError{Key: key, Err: err}
+		}
+		seen := make(map[string]bool)
+		for k := range values {
+			i := strings.LastIndex(k, ".")
+			if i < 0 || seen[k[:i]] || !re.MatchString(k[:i]) {
+				continue
+			}
+			seen[k[:i]] = true
+			instances = append(instances, k[:i])
+		}
+	}
+
+	for _, metric := range graph.Metrics {
+		if metric.Expr == "" {
+			continue
+		}
+		e, err := parseExpr(metric.Expr)
+		if err != nil {
+			return &DefinitionError{Key: key, Metric: metric.Name, Err: err}
+		}
+		if !wildcard {
+			mp.formatDerivedValue(key, metric, e, values, "", now)
+			continue
+		}
+		for _, instance := range instances {
+			mp.formatDerivedValue("", metric, e, values, instance+".", now)
+		}
+	}
+	return nil
+}
+
+func (mp *MackerelPlugin) formatDerivedValue(prefix string, metric Metrics, e expr, values map[string]float64, instance string, now time.Time) {
+	value, err := e.eval(func(name string) (float64, bool) {
+		v, ok := values[instance+name]
+		return v, ok
+	})
+	key := mp.metricKey(prefix, instance+metric.Name)
+	var dbg *debugRow
+	if mp.debugEnabled() {
+		dbg = newDebugRow(key, "="+metric.Expr, metric)
+		defer mp.printDebugRow(dbg)
+	}
+	if err != nil {
+		mp.logger().Printf("OutputValues: %s%s: %v\n", instance, metric.Name, err)
+		return
+	}
 	if metric.Scale != 0 {
 		value *= metric.Scale
 	}
+	if dbg != nil {
+		dbg.value = formatDebugFloat(value)
+	} else {
+		mp.printValue(mp.getWriter(), key, Float(value), now)
+	}
+}
+
+// joinKey joins a graph key and a metric name.
+func joinKey(key string, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
 
+// metricKey returns the key of the metric to output.
+func (mp *MackerelPlugin) metricKey(prefix string, name string) string {
 	metricNames := []string{}
-	if p, ok := mp.Plugin.(PluginWithPrefix); ok {
-		metricNames = append(metricNames, p.MetricKeyPrefix())
+	if p := mp.metricKeyPrefix(); p != "" {
+		metricNames = append(metricNames, p)
 	}
 	if prefix != "" {
 		metricNames = append(metricNames, prefix)
 	}
-	metricNames = append(metricNames, metric.Name)
-	mp.printValue(mp.getWriter(), strings.Join(metricNames, "."), value, now)
+	metricNames = append(metricNames, name)
+	return strings.Join(metricNames, ".")
 }
 
 // GraphDef is graph definitions
@@ -316,13 +713,26 @@ func title(s string) string {
 
 // OutputDefinitions outputs graph definitions
 func (mp *MackerelPlugin) OutputDefinitions() {
-	fmt.Fprintln(mp.getWriter(), "# mackerel-agent-plugin") // nolint
+	if err := mp.OutputDefinitionsE(); err != nil {
+		mp.logger().Fatalln("OutputDefinitions: ", err)
+	}
+}
+
+// OutputDefinitionsE outputs graph definitions like OutputDefinitions, but returns an error instead of exiting.
+func (mp *MackerelPlugin) OutputDefinitionsE() error {
+	if err := mp.setupFormatter(); err != nil {
+		return err
+	}
+	return mp.formatter().FormatDefinitions(mp.getWriter(), mp.graphDefinitions())
+}
+
+// graphDefinitions returns graph definitions with the metric key prefix and default labels.
+func (mp *MackerelPlugin) graphDefinitions() map[string]Graphs {
 	graphs := make(map[string]Graphs)
 	for key, graph := range mp.GraphDefinition() {
 		g := graph
 		k := key
-		if p, ok := mp.Plugin.(PluginWithPrefix); ok {
-			prefix := p.MetricKeyPrefix()
+		if prefix := mp.metricKeyPrefix(); prefix != "" {
 			if k == "" {
 				k = prefix
 			} else {
@@ -342,20 +752,33 @@ func (mp *MackerelPlugin) OutputDefinitions() {
 		g.Metrics = metrics
 		graphs[k] = g
 	}
-	var graphdef GraphDef
-	graphdef.Graphs = graphs
-	b, err := json.Marshal(graphdef)
-	if err != nil {
-		log.Fatalln("OutputDefinitions: ", err)
-	}
-	fmt.Fprintln(mp.getWriter(), string(b)) // nolint
+	return graphs
 }
 
 // Run the plugin
 func (mp *MackerelPlugin) Run() {
+	if err := mp.RunE(); err != nil {
+		mp.exitWithError(err)
+	}
+}
+
+// exitWithError logs err and exits with ExitCodePartial if err is a PartialError, or 1 otherwise.
+func (mp *MackerelPlugin) exitWithError(err error, v ...interface{}) {
+	mp.logger().Println(append(v, err)...)
+	var pe *PartialError
+	if errors.As(err, &pe) {
+		os.Exit(ExitCodePartial)
+	}
+	os.Exit(1)
+}
+
+// RunE runs the plugin like Run, but returns an error instead of exiting.
+func (mp *MackerelPlugin) RunE() error {
+	if os.Getenv("MACKEREL_PLUGIN_VALIDATE") != "" {
+		return mp.validate()
+	}
 	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
-		mp.OutputDefinitions()
-	} else {
-		mp.OutputValues()
+		return mp.OutputDefinitionsE()
 	}
+	return mp.OutputValuesE()
 }
@@ -2,8 +2,11 @@ package mackerelplugin
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"log"
 	"math"
 	"os"
 	"path/filepath"
@@ -17,14 +20,14 @@ import (
 func TestCalcDiff(t *testing.T) {
 	var mp *MackerelPlugin
 
-	val1 := 10.0
-	val2 := 0.0
+	val1 := Float(10.0)
+	val2 := Float(0.0)
 	now := time.Now()
-	last := time.Unix(now.Unix()-10, 0)
+	last := now.Add(-10 * time.Second)
 
-	diff, err := mp.calcDiff(val1, now, val2, last)
-	if diff != 60.0 {
-		t.Errorf("calcDiff: %f should be %f", diff, 60.0)
+	diff, err := mp.calcDiff(Metrics{}, val1, now, val2, last)
+	if diff.Float64() != 60.0 {
+		t.Errorf("calcDiff: %v should be %f", diff, 60.0)
 	}
 	if err != nil {
 		t.Error("calcDiff causes an error")
@@ -34,20 +37,91 @@ func TestCalcDiff(t *testing.T) {
 func TestCalcDiffWithReset(t *testing.T) {
 	var mp *MackerelPlugin
 
-	val := 10.0
-	lastval := 12345.0
+	val := Float(10.0)
+	lastval := Float(12345.0)
 	now := time.Now()
 	last := time.Unix(now.Unix()-60, 0)
 
-	diff, err := mp.calcDiff(val, now, lastval, last)
+	diff, err := mp.calcDiff(Metrics{}, val, now, lastval, last)
 	if err == nil {
-		t.Errorf("calcDiff with counter reset should cause an error: %f", diff)
+		t.Errorf("calcDiff with counter reset should cause an error: %v", diff)
+	}
+}
+
+func TestCalcDiffWithCounterOptions(t *testing.T) {
+	var mp *MackerelPlugin
+
+	now := time.Unix(1437227240, 0)
+	tests := []struct {
+		name      string
+		metric    Metrics
+		value     float64
+		lastValue float64
+		lastTime  time.Time
+		want      float64
+		wantErr   bool
+	}{
+		{"32bit wraparound", Metrics{CounterBits: 32}, 10, math.MaxUint32 - 19, now.Add(-time.Minute), 30, false},
+		{"64bit wraparound", Metrics{CounterBits: 64}, 0, 1 << 63, now.Add(-time.Minute), 1 << 63, false},
+		{"too large for 32bit counter", Metrics{CounterBits: 32}, 10, 1 << 40, now.Add(-time.Minute), 0, true},
+		{"reset as zero", Metrics{ResetAsZero: true}, 10, 12345, now.Add(-time.Minute), 10, false},
+		{"default max interval", Metrics{}, 20, 10, now.Add(-601 * time.Second), 0, true},
+		{"max interval", Metrics{MaxInterval: time.Hour}, 70, 10, now.Add(-30 * time.Minute), 2, false},
+		{"same time", Metrics{}, 20, 10, now, 0, true},
+		{"per second", Metrics{DiffMode: DiffPerSecond}, 70, 10, now.Add(-30 * time.Second), 2, false},
+		{"delta", Metrics{DiffMode: DiffDelta}, 70, 10, now.Add(-30 * time.Second), 60, false},
+	}
+	for _, tt := range tests {
+		diff, err := mp.calcDiff(tt.metric, Float(tt.value), now, Float(tt.lastValue), tt.lastTime)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: calcDiff returns an error %v", tt.name, err)
+			continue
+		}
+		if diff.Float64() != tt.want {
+			t.Errorf("%s: calcDiff = %v; want %f", tt.name, diff, tt.want)
+		}
+	}
+}
+
+func TestFormatValuesSkipsInvalidDiff(t *testing.T) {
+	wtr := &bytes.Buffer{}
+	mp := &MackerelPlugin{Writer: wtr}
+
+	metric := Metrics{Name: "cmd_get", Label: "Get", Diff: true}
+	stat := map[string]float64{"cmd_get": 100.0}
+	lastStat := map[string]float64{"cmd_get": 500.0}
+	now := time.Unix(1437227240, 0)
+	lastTime := now.Add(time.Second * (-60))
+	mp.formatValues("foo", metric, floatValues(stat), &State{Values: floatValues(lastStat), Time: lastTime}, now)
+
+	if got := wtr.String(); got != "" {
+		t.Errorf("formatValues should not output reset counters: %q", got)
+	}
+}
+
+func TestFormatValuesWithLastSeen(t *testing.T) {
+	wtr := &bytes.Buffer{}
+	mp := &MackerelPlugin{Writer: wtr}
+
+	metric := Metrics{Name: "cmd_get", Label: "Get", Diff: true}
+	stat := map[string]float64{"cmd_get": 1000.0}
+	now := time.Unix(1437227240, 0)
+	last := &State{
+		Values:   map[string]Value{"cmd_get": Float(500.0)},
+		Time:     now.Add(-time.Minute),
+		LastSeen: map[string]time.Time{"cmd_get": now.Add(-5 * time.Minute)},
+	}
+	mp.formatValues("foo", metric, floatValues(stat), last, now)
+
+	expect := "foo.cmd_get\t100\t1437227240\n"
+	if got := wtr.String(); got != expect {
+		t.Errorf("differentials should be calculated from the time the value was seen last: %q", got)
 	}
 }
 
 func TestFormatValues(t *testing.T) {
 	wtr := &bytes.Buffer{}
-	mp := &MackerelPlugin{writer: wtr}
+	mp := &MackerelPlugin{Writer: wtr}
 
 	prefix := "foo"
 	metric := Metrics{Name: "cmd_get", Label: "Get", Diff: true}
@@ -55,7 +129,7 @@ func TestFormatValues(t *testing.T) {
 	lastStat := map[string]float64{"cmd_get": 500.0, ".last_diff.cmd_get": 300.0}
 	now := time.Unix(1437227240, 0)
 	lastTime := now.Add(time.Second * (-60))
-	mp.formatValues(prefix, metric, stat, lastStat, now, lastTime)
+	mp.formatValues(prefix, metric, floatValues(stat), &State{Values: floatValues(lastStat), Time: lastTime}, now)
 
 	got := wtr.String()
 	expect := "foo.cmd_get	500	1437227240\n"
@@ -64,6 +138,16 @@ func TestFormatValues(t *testing.T) {
 	}
 }
 
+func TestFormatValuesReadsOnlyMetricNames(t *testing.T) {
+	wtr := &bytes.Buffer{}
+	mp := &MackerelPlugin{Plugin: testPSameNames{}, Writer: wtr}
+
+	metric := Metrics{Name: "bar"}
+	if _, ok := mp.formatValues("foo", metric, floatValues(map[string]float64{"foo.bar": 1}), nil, time.Now()); ok {
+		t.Errorf("formatValues should not read the value keyed with the graph key: %s", wtr.String())
+	}
+}
+
 // an example implementation
 type testMemcachedPlugin struct {
 }
@@ -91,7 +175,7 @@ func TestOutputDefinitions(t *testing.T) {
 	var m testMemcachedPlugin
 	mp := NewMackerelPlugin(m)
 	wtr := &bytes.Buffer{}
-	mp.writer = wtr
+	mp.Writer = wtr
 	mp.OutputDefinitions()
 
 	expect := `# mackerel-agent-plugin
@@ -107,7 +191,7 @@ func TestOutputValues(t *testing.T) {
 	var m testMemcachedPlugin
 	mp := NewMackerelPlugin(m)
 	wtr := &bytes.Buffer{}
-	mp.writer = wtr
+	mp.Writer = wtr
 	mp.OutputValues()
 	epoch := time.Now().Unix()
 	expect := fmt.Sprintf("memcached.cmd.cmd_get\t%d\t%d\n", 11, epoch)
@@ -213,7 +297,7 @@ func TestTempfilenameFromExecutableFilePath(t *testing.T) {
 func TestPluginOutputDefinitionsWithPrefix(t *testing.T) {
 	mp := NewMackerelPlugin(testP{})
 	wtr := &bytes.Buffer{}
-	mp.writer = wtr
+	mp.Writer = wtr
 	mp.OutputDefinitions()
 	expect := `# mackerel-agent-plugin
 {"graphs":{"testP":{"label":"TestP","unit":"integer","metrics":[{"name":"bar","label":"Bar","stacked":false}]},"testP.fuga":{"label":"TestP Fuga","unit":"float","metrics":[{"name":"baz","label":"Baz","stacked":false}]}}}
@@ -227,7 +311,7 @@ func TestPluginOutputDefinitionsWithPrefix(t *testing.T) {
 func TestOutputValuesWithPrefix(t *testing.T) {
 	mp := NewMackerelPlugin(testP{})
 	wtr := &bytes.Buffer{}
-	mp.writer = wtr
+	mp.Writer = wtr
 	mp.OutputValues()
 	epoch := time.Now().Unix()
 	expect := fmt.Sprintf("testP.bar\t15\t%[1]d\ntestP.fuga.baz\t18\t%[1]d\n", epoch)
@@ -283,14 +367,14 @@ func TestPluginHasDiff(t *testing.T) {
 
 func TestFormatValuesWithWildcard(t *testing.T) {
 	wtr := &bytes.Buffer{}
-	mp := &MackerelPlugin{writer: wtr}
+	mp := &MackerelPlugin{Writer: wtr}
 	prefix := "foo.#"
 	metric := Metrics{Name: "bar", Label: "Get", Diff: true}
 	stat := map[string]float64{"foo.1.bar": 1000.0, "foo.2.bar": 2000.0}
 	lastStat := map[string]float64{"foo.1.bar": 500.0, ".last_diff.foo.1.bar": 2.0}
 	now := time.Unix(1437227240, 0)
 	lastTime := now.Add(time.Second * (-60))
-	mp.formatValuesWithWildcard(prefix, metric, stat, lastStat, now, lastTime)
+	mp.formatValuesWithWildcard(prefix, metric, floatValues(stat), &State{Values: floatValues(lastStat), Time: lastTime}, now)
 
 	expect := "foo.1.bar	500	1437227240\n"
 	got := wtr.String()
@@ -301,14 +385,14 @@ func TestFormatValuesWithWildcard(t *testing.T) {
 
 func TestFormatValuesWithWildcardAndNoDiff(t *testing.T) {
 	wtr := &bytes.Buffer{}
-	mp := &MackerelPlugin{writer: wtr}
+	mp := &MackerelPlugin{Writer: wtr}
 	prefix := "foo.#"
 	metric := Metrics{Name: "bar", Label: "Get", Diff: false}
 	stat := map[string]float64{"foo.1.bar": 1000.0}
 	lastStat := map[string]float64{"foo.1.bar": 500.0, ".last_diff.foo.1.bar": 2.0}
 	now := time.Unix(1437227240, 0)
 	lastTime := now.Add(time.Second * (-60))
-	mp.formatValuesWithWildcard(prefix, metric, stat, lastStat, now, lastTime)
+	mp.formatValuesWithWildcard(prefix, metric, floatValues(stat), &State{Values: floatValues(lastStat), Time: lastTime}, now)
 
 	expect := "foo.1.bar	1000	1437227240\n"
 	got := wtr.String()
@@ -317,16 +401,34 @@ func TestFormatValuesWithWildcardAndNoDiff(t *testing.T) {
 	}
 }
 
+func TestFormatValuesWithWildcardAndDiffMode(t *testing.T) {
+	wtr := &bytes.Buffer{}
+	mp := &MackerelPlugin{Writer: wtr}
+	prefix := "foo.#"
+	metric := Metrics{Name: "bar", Label: "Get", Diff: true, DiffMode: DiffPerSecond}
+	stat := map[string]float64{"foo.1.bar": 1000.0}
+	lastStat := map[string]float64{"foo.1.bar": 400.0}
+	now := time.Unix(1437227240, 0)
+	lastTime := now.Add(time.Second * (-60))
+	mp.formatValuesWithWildcard(prefix, metric, floatValues(stat), &State{Values: floatValues(lastStat), Time: lastTime}, now)
+
+	expect := "foo.1.bar	10	1437227240\n"
+	got := wtr.String()
+	if got != expect {
+		t.Errorf("something went wrong: %s", got)
+	}
+}
+
 func TestFormatValuesWithWildcardAstarisk(t *testing.T) {
 	wtr := &bytes.Buffer{}
-	mp := &MackerelPlugin{writer: wtr}
+	mp := &MackerelPlugin{Writer: wtr}
 	prefix := "foo"
 	metric := Metrics{Name: "*", Label: "Get", Diff: true}
 	stat := map[string]float64{"foo.1": 1000.0, "foo.2": 2000.0}
 	lastStat := map[string]float64{"foo.1": 500.0, ".last_diff.foo.1": 2.0}
 	now := time.Unix(1437227240, 0)
 	lastTime := now.Add(time.Second * (-60))
-	mp.formatValuesWithWildcard(prefix, metric, stat, lastStat, now, lastTime)
+	mp.formatValuesWithWildcard(prefix, metric, floatValues(stat), &State{Values: floatValues(lastStat), Time: lastTime}, now)
 
 	expect := "foo.1	500	1437227240\n"
 	got := wtr.String()
@@ -368,7 +470,7 @@ func (t testPWithWildcard) MetricKeyPrefix() string {
 func TestPluginOutputDefinitionsWithPrefixAndWildcard(t *testing.T) {
 	mp := NewMackerelPlugin(testPWithWildcard{})
 	wtr := &bytes.Buffer{}
-	mp.writer = wtr
+	mp.Writer = wtr
 	t.Setenv("MACKEREL_AGENT_PLUGIN_META", "1")
 	mp.Run()
 	expect := `# mackerel-agent-plugin
@@ -383,7 +485,7 @@ func TestPluginOutputDefinitionsWithPrefixAndWildcard(t *testing.T) {
 func TestOutputValuesWithPrefixAndWildcard(t *testing.T) {
 	mp := NewMackerelPlugin(testPWithWildcard{})
 	wtr := &bytes.Buffer{}
-	mp.writer = wtr
+	mp.Writer = wtr
 	mp.Run()
 	epoch := time.Now().Unix()
 	expect := fmt.Sprintf("testPWithWildcard.piyo.1.bar\t11\t%[1]d\n"+
@@ -423,12 +525,12 @@ func sortLines(s string) string {
 func TestFetchLastValuesIfNotExist(t *testing.T) {
 	p := NewMackerelPlugin(testPHasDiff{})
 	p.Tempfile = "state_file_should_not_exist.json"
-	_, last, err := p.fetchLastValues(time.Now())
+	last, err := p.fetchLastValues(time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !last.IsZero() {
-		t.Errorf("Timestamp = %v; want 0001-01-01", last)
+	if last != nil {
+		t.Errorf("fetchLastValues = %v; want nil", last)
 	}
 }
 
@@ -447,12 +549,12 @@ func TestFetchLastValuesIfFileIsBroken(t *testing.T) {
 	if _, err := f.Seek(0, 0); err != nil {
 		t.Fatal(err)
 	}
-	_, last, err := p.fetchLastValues(time.Now())
+	last, err := p.fetchLastValues(time.Now())
 	if err == nil {
 		t.Errorf("fetchLastValues should return an error; state is broken")
 	}
-	if !last.IsZero() {
-		t.Errorf("Timestamp = %v; want 0001-01-01", last)
+	if last != nil {
+		t.Errorf("fetchLastValues = %v; want nil", last)
 	}
 }
 
@@ -465,17 +567,52 @@ func TestFetchLastValuesReadStateSameTime(t *testing.T) {
 	defer f.Close() // nolint
 	p.Tempfile = f.Name()
 	now := time.Now()
-	stats := make(map[string]float64)
-	if err := p.saveValues(stats, now); err != nil {
+	stats := make(map[string]Value)
+	if err := p.saveValues(p.nextState(stats, nil, now)); err != nil {
 		t.Fatal(err)
 	}
 
-	_, last, err := p.fetchLastValues(now)
+	last, err := p.fetchLastValues(now)
 	if err != errStateRecentlyUpdated {
 		t.Errorf("fetchLastValues: %v; want %v", err, errStateRecentlyUpdated)
 	}
-	if !last.IsZero() {
-		t.Errorf("fetchLastValues: last should be zero; but %v", last)
+	if last != nil {
+		t.Errorf("fetchLastValues: last should be nil; but %v", last)
+	}
+}
+
+func TestNextStateWithRetention(t *testing.T) {
+	now := time.Unix(1437227240, 0)
+	last := &State{
+		Values: map[string]Value{"kept": Int(1), "expired": Int(2), "updated": Int(3)},
+		Time:   now.Add(-time.Minute),
+		LastSeen: map[string]time.Time{
+			"kept":    now.Add(-5 * time.Minute),
+			"expired": now.Add(-20 * time.Minute),
+			"updated": now.Add(-time.Minute),
+		},
+	}
+	stat := map[string]Value{"updated": Int(4), "new": Int(5)}
+
+	mp := NewMackerelPlugin(testPHasDiff{})
+	state := mp.nextState(stat, last, now)
+	if !reflect.DeepEqual(state.Values, stat) {
+		t.Errorf("missing values should be dropped without StateRetention: %v", state.Values)
+	}
+
+	mp.StateRetention = 10 * time.Minute
+	state = mp.nextState(stat, last, now)
+	want := map[string]Value{"kept": Int(1), "updated": Int(4), "new": Int(5)}
+	if !reflect.DeepEqual(state.Values, want) {
+		t.Errorf("nextState = %v; want %v", state.Values, want)
+	}
+	wantSeen := map[string]time.Time{
+		"kept":    now.Add(-5 * time.Minute),
+		"updated": now,
+		"new":     now,
+	}
+	if !reflect.DeepEqual(state.LastSeen, wantSeen) {
+		t.Errorf("LastSeen = %v; want %v", state.LastSeen, wantSeen)
 	}
 }
 
@@ -497,18 +634,314 @@ func TestSaveStateIfContainsInvalidNumbers(t *testing.T) {
 	const lastTime = 1624848982
 
 	now := time.Unix(lastTime, 0)
-	if err := p.saveValues(stats, now); err != nil {
+	if err := p.saveValues(p.nextState(floatValues(stats), nil, now)); err != nil {
 		t.Errorf("saveValues: %v", err)
 	}
-	stats, _, err = p.fetchLastValues(now.Add(time.Second))
+	last, err := p.fetchLastValues(now.Add(time.Second))
 	if err != nil {
 		t.Fatal("fetchLastValues:", err)
 	}
-	want := map[string]float64{
-		"_lastTime": lastTime,
-		"key1":      3.0,
+	want := map[string]Value{
+		"key1": Float(3.0),
+	}
+	if !reflect.DeepEqual(last.Values, want) {
+		t.Errorf("saveValues stores only valid numbers: got %v; want %v", last.Values, want)
+	}
+}
+
+type testPWithContext struct{}
+
+func (t testPWithContext) FetchMetrics() (map[string]float64, error) {
+	return t.FetchMetricsContext(context.Background())
+}
+
+func (t testPWithContext) FetchMetricsContext(ctx context.Context) (map[string]float64, error) {
+	stat := map[string]float64{"bar": 15.0}
+	<-ctx.Done()
+	return stat, ctx.Err()
+}
+
+func (t testPWithContext) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"hoge": {
+			Metrics: []Metrics{
+				{Name: "bar"},
+				{Name: "baz"},
+			},
+		},
+	}
+}
+
+func TestOutputValuesWithTimeout(t *testing.T) {
+	mp := NewMackerelPlugin(testPWithContext{})
+	mp.Timeout = 10 * time.Millisecond
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	err := mp.OutputValuesE()
+	var pe *PartialError
+	if !errors.As(err, &pe) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("OutputValuesE should return a PartialError of the timeout: %v", err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("hoge.bar\t15\t%d\n", epoch)
+	got := wtr.String()
+	if got != expect {
+		t.Errorf("result of OutputValues is invalid :%s", got)
 	}
-	if !reflect.DeepEqual(stats, want) {
-		t.Errorf("saveValues stores only valid numbers: got %v; want %v", stats, want)
+}
+
+type testPPartial struct {
+	testPHasDiff
+	stat map[string]float64
+}
+
+func (t testPPartial) FetchMetrics() (map[string]float64, error) {
+	return t.stat, &PartialError{Err: errors.New("failed to fetch hoge2")}
+}
+
+func TestOutputValuesWithPartialError(t *testing.T) {
+	store := &MemoryStateStore{}
+	mp := NewMackerelPlugin(testPPartial{stat: map[string]float64{"hoge1": 15}})
+	mp.StateStore = store
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	err := mp.OutputValuesE()
+	var pe *PartialError
+	if !errors.As(err, &pe) {
+		t.Errorf("OutputValuesE should return a PartialError: %v", err)
+	}
+	if wtr.String() != "" {
+		t.Errorf("nothing should be output at the first run: %q", wtr.String())
+	}
+	state, _ := store.Load()
+	if state == nil || !reflect.DeepEqual(state.Values, map[string]Value{"hoge1": Float(15)}) {
+		t.Errorf("only values fetched should be saved: %v", state)
+	}
+
+	// PartialError without any values is a failure.
+	mp = NewMackerelPlugin(testPPartial{})
+	mp.StateStore = &MemoryStateStore{}
+	mp.Writer = &bytes.Buffer{}
+	var fetchErr *FetchError
+	if err := mp.OutputValuesE(); !errors.As(err, &fetchErr) {
+		t.Errorf("OutputValuesE should return a FetchError: %v", err)
+	}
+}
+
+type testPBlocking struct {
+	testPHasntDiff
+	c chan struct{}
+}
+
+func (t testPBlocking) FetchMetrics() (map[string]float64, error) {
+	<-t.c
+	return nil, nil
+}
+
+func TestFetchMetricsTimeoutWithoutContext(t *testing.T) {
+	p := testPBlocking{c: make(chan struct{})}
+	defer close(p.c)
+	mp := NewMackerelPlugin(p)
+	mp.Timeout = 10 * time.Millisecond
+	_, err := mp.fetchMetrics(context.Background(), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetchMetrics: %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFetchMetricsSkipsWhileAbandonedFetchRuns(t *testing.T) {
+	p := testPBlocking{c: make(chan struct{})}
+	mp := NewMackerelPlugin(p)
+	mp.Timeout = 10 * time.Millisecond
+	var f fetcher
+	if _, err := mp.fetchMetrics(context.Background(), &f); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetchMetrics: %v; want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := mp.fetchMetrics(context.Background(), &f); err != errFetchRunning {
+		t.Errorf("fetchMetrics while the last fetch is running: %v; want %v", err, errFetchRunning)
+	}
+
+	close(p.c)
+	for f.running.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := mp.fetchMetrics(context.Background(), &f); err != nil {
+		t.Errorf("fetchMetrics after the last fetch returns: %v", err)
+	}
+}
+
+type testPFailing struct {
+	testPHasntDiff
+}
+
+func (t testPFailing) FetchMetrics() (map[string]float64, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestOutputValuesEWithFetchError(t *testing.T) {
+	mp := NewMackerelPlugin(testPFailing{})
+	mp.Writer = &bytes.Buffer{}
+	err := mp.OutputValuesE()
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Errorf("OutputValuesE: %v; want *FetchError", err)
+	}
+}
+
+func TestOutputValuesEWithStateError(t *testing.T) {
+	mp := NewMackerelPlugin(testPHasDiff{})
+	mp.Writer = &bytes.Buffer{}
+	// Tempfile can not be replaced because it is a directory.
+	mp.Tempfile = t.TempDir()
+	err := mp.OutputValuesE()
+	var stateErr *StateError
+	if !errors.As(err, &stateErr) {
+		t.Fatalf("OutputValuesE: %v; want *StateError", err)
+	}
+	if stateErr.Op != "write" {
+		t.Errorf("StateError.Op = %q; want %q", stateErr.Op, "write")
+	}
+}
+
+func TestFormatValuesWithWildcardInvalidDefinition(t *testing.T) {
+	mp := &MackerelPlugin{Writer: &bytes.Buffer{}}
+	metric := Metrics{Name: "bar"}
+	_, err := mp.formatValuesWithWildcard("foo(#", metric, nil, nil, time.Now())
+	var defErr *DefinitionError
+	if !errors.As(err, &defErr) {
+		t.Errorf("formatValuesWithWildcard: %v; want *DefinitionError", err)
+	}
+}
+
+type testPWithDerived struct{}
+
+func (t testPWithDerived) FetchMetrics() (map[string]float64, error) {
+	return map[string]float64{
+		"get_hits":              30,
+		"get_misses":            10,
+		"server.a.bytes_read":   60,
+		"server.a.bytes_cached": 15,
+		"server.b.bytes_read":   0,
+	}, nil
+}
+
+func (t testPWithDerived) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"cache": {
+			Metrics: []Metrics{
+				{Name: "get_hits"},
+				{Name: "get_misses"},
+				{Name: "hit_ratio", Expr: "get_hits / (get_hits + get_misses)", Scale: 100},
+			},
+		},
+		"server.#": {
+			Metrics: []Metrics{
+				{Name: "bytes_read", Scale: 2},
+				{Name: "bytes_cached", Scale: 2},
+				{Name: "cached_ratio", Expr: "bytes_cached / bytes_read"},
+			},
+		},
+	}
+}
+
+func TestOutputValuesWithDerivedMetrics(t *testing.T) {
+	mp := NewMackerelPlugin(testPWithDerived{})
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("cache.get_hits\t30\t%[1]d\n"+
+		"cache.get_misses\t10\t%[1]d\n"+
+		"cache.hit_ratio\t75\t%[1]d\n"+
+		"server.a.bytes_read\t120\t%[1]d\n"+
+		"server.a.bytes_cached\t30\t%[1]d\n"+
+		"server.a.cached_ratio\t0.250000\t%[1]d\n"+
+		"server.b.bytes_read\t0\t%[1]d\n", epoch)
+	got := wtr.String()
+	if sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid :%s", got)
+	}
+}
+
+func TestPrefixOverridesMetricKeyPrefix(t *testing.T) {
+	for _, p := range []Plugin{testP{}, testPHasntDiff{}} {
+		mp := NewMackerelPlugin(p)
+		mp.Prefix = "app.custom"
+		wtr := &bytes.Buffer{}
+		mp.Writer = wtr
+		if err := mp.OutputDefinitionsE(); err != nil {
+			t.Fatal(err)
+		}
+		if got := wtr.String(); !strings.Contains(got, `"app.custom.`) && !strings.Contains(got, `"app.custom"`) {
+			t.Errorf("%T: graph names should be prefixed: %s", p, got)
+		}
+
+		expect := filepath.Join(os.TempDir(), "mackerel-plugin-app.custom-da39a3ee5e6b4b0d3255bfef95601890afd80709")
+		if got := mp.generateTempfilePath([]string{"foo"}); got != expect {
+			t.Errorf("%T: generateTempfilePath() should be %s, but: %s", p, expect, got)
+		}
+	}
+
+	mp := NewMackerelPlugin(testP{})
+	mp.Prefix = "app.custom"
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	mp.OutputValues()
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("app.custom.bar\t15\t%[1]d\napp.custom.fuga.baz\t18\t%[1]d\n", epoch)
+	got := wtr.String()
+	if sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid :%s", got)
+	}
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestOutputValuesWithClock(t *testing.T) {
+	values := make(map[string]Value)
+	clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	wtr := &bytes.Buffer{}
+	logs := &bytes.Buffer{}
+	mp := NewMackerelPlugin(testPWithValues{values: values})
+	mp.StateStore = &MemoryStateStore{}
+	mp.Clock = clock
+	mp.Writer = wtr
+	mp.Logger = log.New(logs, "", 0)
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		value   Value
+		expect  string
+		log     string
+	}{
+		{"first run", 0, Int(100), "", ""},
+		{"recently updated", 500 * time.Millisecond, Int(130), "", errStateRecentlyUpdated.Error()},
+		{"a minute after the first run", 59500 * time.Millisecond, Int(160), "hoge.hoge1\t60\t1577836860\n", ""},
+		{"too long duration", 601 * time.Second, Int(200), "", ""},
+		{"a minute after skipped", time.Minute, Int(230), "hoge.hoge1\t30\t1577837521\n", ""},
+	}
+	for _, tt := range tests {
+		clock.now = clock.now.Add(tt.elapsed)
+		values["hoge1"] = tt.value
+		wtr.Reset()
+		logs.Reset()
+		if err := mp.OutputValuesE(); err != nil {
+			t.Fatalf("%s: OutputValuesE returns an error %v", tt.name, err)
+		}
+		if got := wtr.String(); got != tt.expect {
+			t.Errorf("%s: OutputValuesE outputs %q; want %q", tt.name, got, tt.expect)
+		}
+		if !strings.Contains(logs.String(), tt.log) {
+			t.Errorf("%s: logs %q; want to contain %q", tt.name, logs.String(), tt.log)
+		}
 	}
 }
@@ -0,0 +1,54 @@
+package mackerelplugintest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/go-mackerel-plugin"
+)
+
+// FormatMetrics formats metrics as lines of name and value separated by a tab.
+// Timestamps are excluded so that the result does not depend on the clock.
+func FormatMetrics(metrics []Metric) []byte {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "%s\t%s\n", m.Name, m.Value) // nolint
+	}
+	return buf.Bytes()
+}
+
+// FormatDefinitions formats graph definitions as indented JSON sorted by graph keys.
+func FormatDefinitions(graphs map[string]mackerelplugin.Graphs) []byte {
+	b, err := json.MarshalIndent(graphs, "", "  ")
+	if err != nil {
+		// Graphs consist of strings and booleans only.
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// AssertGolden compares got with the content of the golden file at path.
+// If MACKEREL_PLUGIN_UPDATE_GOLDEN environment variable is set, the golden file is written with got instead.
+func AssertGolden(t testing.TB, path string, got []byte) {
+	t.Helper()
+	if os.Getenv("MACKEREL_PLUGIN_UPDATE_GOLDEN") != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v; set MACKEREL_PLUGIN_UPDATE_GOLDEN=1 to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
@@ -0,0 +1,147 @@
+// Package mackerelplugintest provides utilities for testing plugins of go-mackerel-plugin.
+//
+// Harness runs a plugin through simulated invocations, as mackerel-agent runs it every minute,
+// with a fake clock and in-memory state, and returns the emitted metrics.
+//
+//	h := mackerelplugintest.New(MemcachedPlugin{Target: addr})
+//	runs, err := h.RunN(2)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	mackerelplugintest.AssertGolden(t, "testdata/memcached.golden", mackerelplugintest.FormatMetrics(runs[1]))
+package mackerelplugintest
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mackerelio/go-mackerel-plugin"
+)
+
+// Metric is a metric value emitted by a plugin
+type Metric struct {
+	Name  string
+	Value mackerelplugin.Value
+	Time  time.Time
+}
+
+// DefaultStart is the time of the first invocation unless Start of Harness is specified
+var DefaultStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Harness runs a plugin through simulated invocations.
+// The state is kept in memory between invocations, and the clock advances by Interval on each invocation.
+// Harness is the Clock of MackerelPlugin during invocations.
+type Harness struct {
+	Plugin mackerelplugin.Plugin
+	// Start is the time of the first invocation.
+	Start time.Time
+	// Interval is the duration between invocations. The default is a minute.
+	Interval time.Duration
+	// Setup is called with MackerelPlugin before each invocation to set options such as Prefix.
+	Setup func(*mackerelplugin.MackerelPlugin)
+
+	store *mackerelplugin.MemoryStateStore
+	now   time.Time
+}
+
+// New returns new Harness for p
+func New(p mackerelplugin.Plugin) *Harness {
+	return &Harness{Plugin: p}
+}
+
+// Now returns the time of the next invocation
+func (h *Harness) Now() time.Time {
+	h.init()
+	return h.now
+}
+
+// Advance advances the clock by d in addition to Interval,
+// for example to simulate invocations skipped by mackerel-agent.
+func (h *Harness) Advance(d time.Duration) {
+	h.init()
+	h.now = h.now.Add(d)
+}
+
+func (h *Harness) init() {
+	if h.store != nil {
+		return
+	}
+	h.store = &mackerelplugin.MemoryStateStore{}
+	h.now = h.Start
+	if h.now.IsZero() {
+		h.now = DefaultStart
+	}
+}
+
+func (h *Harness) interval() time.Duration {
+	if h.Interval <= 0 {
+		return time.Minute
+	}
+	return h.Interval
+}
+
+func (h *Harness) newMackerelPlugin(r *recorder) *mackerelplugin.MackerelPlugin {
+	h.init()
+	helper := mackerelplugin.NewMackerelPlugin(h.Plugin)
+	helper.StateStore = h.store
+	helper.Clock = h
+	helper.Formatter = r
+	if h.Setup != nil {
+		h.Setup(helper)
+	}
+	return helper
+}
+
+// Run invokes the plugin once and returns the emitted metrics sorted by name.
+// Partial results are returned along with *mackerelplugin.PartialError.
+func (h *Harness) Run() ([]Metric, error) {
+	r := &recorder{}
+	helper := h.newMackerelPlugin(r)
+	err := helper.OutputValuesE()
+	h.now = h.now.Add(h.interval())
+	sort.SliceStable(r.metrics, func(i, j int) bool {
+		return r.metrics[i].Name < r.metrics[j].Name
+	})
+	return r.metrics, err
+}
+
+// RunN invokes the plugin n times and returns the emitted metrics of each invocation.
+// It stops at the first error.
+func (h *Harness) RunN(n int) ([][]Metric, error) {
+	runs := make([][]Metric, 0, n)
+	for i := 0; i < n; i++ {
+		metrics, err := h.Run()
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, metrics)
+	}
+	return runs, nil
+}
+
+// Definitions returns the graph definitions output by the plugin,
+// with the metric key prefix and default labels applied.
+func (h *Harness) Definitions() (map[string]mackerelplugin.Graphs, error) {
+	r := &recorder{}
+	if err := h.newMackerelPlugin(r).OutputDefinitionsE(); err != nil {
+		return nil, err
+	}
+	return r.graphs, nil
+}
+
+// recorder is a Formatter which records values and graph definitions instead of writing them.
+type recorder struct {
+	metrics []Metric
+	graphs  map[string]mackerelplugin.Graphs
+}
+
+func (r *recorder) FormatValue(w io.Writer, key string, value mackerelplugin.Value, t time.Time) error {
+	r.metrics = append(r.metrics, Metric{Name: key, Value: value.At(time.Time{}), Time: t})
+	return nil
+}
+
+func (r *recorder) FormatDefinitions(w io.Writer, graphs map[string]mackerelplugin.Graphs) error {
+	r.graphs = graphs
+	return nil
+}
@@ -0,0 +1,95 @@
+package mackerelplugintest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/go-mackerel-plugin"
+)
+
+type testPCounter struct {
+	n *int
+}
+
+func (t testPCounter) FetchMetrics() (map[string]float64, error) {
+	*t.n += 30
+	return map[string]float64{"requests": float64(*t.n), "connections": 5}, nil
+}
+
+func (t testPCounter) GraphDefinition() map[string]mackerelplugin.Graphs {
+	return map[string]mackerelplugin.Graphs{
+		"requests": {
+			Label: "Requests",
+			Unit:  mackerelplugin.UnitInteger,
+			Metrics: []mackerelplugin.Metrics{
+				{Name: "requests", Label: "Requests", Diff: true},
+			},
+		},
+		"connections": {
+			Label: "Connections",
+			Unit:  mackerelplugin.UnitInteger,
+			Metrics: []mackerelplugin.Metrics{
+				{Name: "connections", Label: "Connections"},
+			},
+		},
+	}
+}
+
+func (t testPCounter) MetricKeyPrefix() string {
+	return "server"
+}
+
+func TestHarness(t *testing.T) {
+	var n int
+	h := New(testPCounter{n: &n})
+	h.Interval = 30 * time.Second
+	runs, err := h.RunN(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]Metric{
+		{
+			{Name: "server.connections.connections", Value: mackerelplugin.Float(5), Time: DefaultStart},
+		},
+		{
+			{Name: "server.connections.connections", Value: mackerelplugin.Float(5), Time: DefaultStart.Add(30 * time.Second)},
+			{Name: "server.requests.requests", Value: mackerelplugin.Float(60), Time: DefaultStart.Add(30 * time.Second)},
+		},
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("RunN = %v; want %v", runs, want)
+	}
+
+	// The counter is not output if the last value is too old.
+	h.Advance(time.Hour)
+	metrics, err := h.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "server.connections.connections" {
+		t.Errorf("Run = %v; want only connections", metrics)
+	}
+	if want := DefaultStart.Add(time.Hour + 90*time.Second); !h.Now().Equal(want) {
+		t.Errorf("Now = %v; want %v", h.Now(), want)
+	}
+}
+
+func TestHarnessGolden(t *testing.T) {
+	var n int
+	h := New(testPCounter{n: &n})
+	h.Setup = func(helper *mackerelplugin.MackerelPlugin) {
+		helper.Prefix = "web"
+	}
+	runs, err := h.RunN(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertGolden(t, "testdata/counter.golden", FormatMetrics(runs[2]))
+
+	graphs, err := h.Definitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertGolden(t, "testdata/counter_definitions.golden", FormatDefinitions(graphs))
+}
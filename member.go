@@ -0,0 +1,92 @@
+package mackerelplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// member is a plugin fetched along with others by CompositePlugin and MultiInstancePlugin.
+type member struct {
+	// name identifies the member in errors.
+	name    string
+	plugin  Plugin
+	fetcher *fetcher
+}
+
+// fetchMembers fetches metrics from members concurrently and merges them by calling merge
+// for each member in order. Members which fail to fetch metrics are reported by a PartialError
+// along with the values of others; it returns other errors only if all members fail.
+func fetchMembers(ctx context.Context, members []member, merge func(i int, dst map[string]Value, src map[string]Value) error) (map[string]Value, error) {
+	stats := make([]map[string]Value, len(members))
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func(i int, m member) {
+			defer wg.Done()
+			stats[i], errs[i] = fetchMetricsContext(ctx, m.plugin, m.fetcher)
+		}(i, m)
+	}
+	wg.Wait()
+
+	stat := make(map[string]Value)
+	var failed []error
+	for i, m := range members {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", m.name, errs[i]))
+		}
+		if err := merge(i, stat, stats[i]); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return stat, nil
+	case len(failed) == len(members):
+		return stat, errors.Join(failed...)
+	default:
+		return stat, &PartialError{Err: errors.Join(failed...)}
+	}
+}
+
+// walkValues calls f with the graph key and the metric name of each value of src defined in graphs.
+// For graphs and metrics with wildcards, they are the ones matched by the key of the value.
+// Values not defined in graphs are skipped. qualified is passed to lookupValue.
+func walkValues(graphs map[string]Graphs, qualified bool, src map[string]Value, f func(key string, name string, v Value)) error {
+	for key, graph := range graphs {
+		for _, metric := range graph.Metrics {
+			if metric.Expr != "" {
+				continue
+			}
+			if !strings.ContainsAny(key+metric.Name, "*#") {
+				if _, v, ok := lookupValue(src, key, metric, qualified); ok {
+					f(key, metric.Name, v)
+				}
+				continue
+			}
+			pattern := `(` + wildcardPattern(metric.Name) + `)\z`
+			if key != "" {
+				pattern = `(` + wildcardPattern(key) + `)\.` + pattern
+			}
+			re, err := regexp.Compile(`\A` + pattern)
+			if err != nil {
+				return &DefinitionError{Key: key, Metric: metric.Name, Err: err}
+			}
+			for k, v := range src {
+				sub := re.FindStringSubmatch(k)
+				switch {
+				case sub == nil:
+				case key == "":
+					f("", sub[1], v)
+				default:
+					f(sub[1], sub[2], v)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package mackerelplugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MultiInstancePlugin fetches metrics from several instances of a plugin concurrently,
+// for example several memcached servers in one run.
+//
+// The instance name is inserted into metric keys as a wildcard segment after the graph key,
+// so that one graph covers all instances: "memcached.cmd" with metric "cmd_get" becomes
+// "memcached.cmd.#", whose values are output as "memcached.cmd.<instance>.cmd_get".
+// Since metric keys differ by instance, differentials are calculated for each instance separately.
+type MultiInstancePlugin struct {
+	Instances map[string]Plugin
+
+	fetchers map[string]*fetcher
+}
+
+// NewMultiInstancePlugin returns new MultiInstancePlugin.
+// Characters other than [-a-zA-Z0-9_] in instance names are replaced with underscores.
+// It returns an error if instance names collide after the replacement.
+func NewMultiInstancePlugin(instances map[string]Plugin) (*MultiInstancePlugin, error) {
+	m := &MultiInstancePlugin{
+		Instances: make(map[string]Plugin, len(instances)),
+		fetchers:  make(map[string]*fetcher, len(instances)),
+	}
+	origins := make(map[string][]string)
+	for name, p := range instances {
+		sanitized := instanceNameSanitizeReg.ReplaceAllString(name, "_")
+		origins[sanitized] = append(origins[sanitized], name)
+		m.Instances[sanitized] = p
+		m.fetchers[sanitized] = &fetcher{}
+	}
+	var collisions []string
+	for sanitized, names := range origins {
+		if len(names) > 1 {
+			sort.Strings(names)
+			collisions = append(collisions, fmt.Sprintf("%s (%s)", sanitized, strings.Join(names, ", ")))
+		}
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return nil, &DefinitionError{Err: fmt.Errorf("instance names collide: %s", strings.Join(collisions, ", "))}
+	}
+	return m, nil
+}
+
+var instanceNameSanitizeReg = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+func (m *MultiInstancePlugin) names() []string {
+	names := make([]string, 0, len(m.Instances))
+	for name := range m.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MetricKeyPrefix implements PluginWithPrefix.
+// It returns the prefix of the first instance in name order.
+func (m *MultiInstancePlugin) MetricKeyPrefix() string {
+	for _, name := range m.names() {
+		if p, ok := m.Instances[name].(PluginWithPrefix); ok {
+			return p.MetricKeyPrefix()
+		}
+	}
+	return ""
+}
+
+// GraphDefinition implements Plugin.
+// Graphs of all instances are merged; the first instance in name order wins for the same key.
+func (m *MultiInstancePlugin) GraphDefinition() map[string]Graphs {
+	graphs := make(map[string]Graphs)
+	for _, name := range m.names() {
+		for key, graph := range m.Instances[name].GraphDefinition() {
+			k := joinKey(key, "#")
+			if _, ok := graphs[k]; !ok {
+				graphs[k] = graph
+			}
+		}
+	}
+	return graphs
+}
+
+// FetchMetrics implements Plugin
+func (m *MultiInstancePlugin) FetchMetrics() (map[string]float64, error) {
+	return m.FetchMetricsContext(context.Background())
+}
+
+// FetchMetricsContext implements PluginWithContext
+func (m *MultiInstancePlugin) FetchMetricsContext(ctx context.Context) (map[string]float64, error) {
+	stat, err := m.FetchMetricValues(ctx)
+	return float64Values(stat), err
+}
+
+// FetchMetricValues implements PluginWithValues.
+// Instances which fail to fetch metrics are skipped and reported by a PartialError.
+// It returns other errors only if all instances fail.
+func (m *MultiInstancePlugin) FetchMetricValues(ctx context.Context) (map[string]Value, error) {
+	names := m.names()
+	members := make([]member, len(names))
+	for i, name := range names {
+		members[i] = member{name: "instance " + name, plugin: m.Instances[name], fetcher: m.fetchers[name]}
+	}
+	return fetchMembers(ctx, members, func(i int, dst map[string]Value, src map[string]Value) error {
+		instance := names[i]
+		p := m.Instances[instance]
+		return walkValues(p.GraphDefinition(), usesQualifiedKeys(p), src, func(key string, name string, v Value) {
+			dst[joinKey(joinKey(key, instance), name)] = v
+		})
+	})
+}
@@ -0,0 +1,146 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMultiInstancePlugin(t *testing.T, instances map[string]Plugin) *MultiInstancePlugin {
+	t.Helper()
+	m, err := NewMultiInstancePlugin(instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMultiInstancePluginGraphDefinition(t *testing.T) {
+	m := newTestMultiInstancePlugin(t, map[string]Plugin{
+		"a": testPWithWildcard{},
+		"b": testPWithWildcard{},
+	})
+	want := map[string]Graphs{
+		"piyo.#.#": {Metrics: []Metrics{{Name: "bar"}}},
+		"fuga.#":   {Metrics: []Metrics{{Name: "baz"}}},
+	}
+	if got := m.GraphDefinition(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GraphDefinition = %v; want %v", got, want)
+	}
+	if got := m.MetricKeyPrefix(); got != "testPWithWildcard" {
+		t.Errorf("MetricKeyPrefix = %q; want %q", got, "testPWithWildcard")
+	}
+}
+
+func TestMultiInstancePluginFetchMetrics(t *testing.T) {
+	m := newTestMultiInstancePlugin(t, map[string]Plugin{
+		"host-1:11211": testPWithWildcard{},
+		"host-2:11211": testPWithWildcard{},
+		"down":         testPFailing{},
+	})
+	stat, err := m.FetchMetrics()
+	var pe *PartialError
+	if !errors.As(err, &pe) {
+		t.Errorf("FetchMetrics should return a PartialError: %v", err)
+	}
+	want := map[string]float64{
+		"piyo.1.host-1_11211.bar": 11,
+		"piyo.2.host-1_11211.bar": 12,
+		"piyo.3.host-1_11211.bar": 13,
+		"fuga.host-1_11211.baz":   18,
+		"piyo.1.host-2_11211.bar": 11,
+		"piyo.2.host-2_11211.bar": 12,
+		"piyo.3.host-2_11211.bar": 13,
+		"fuga.host-2_11211.baz":   18,
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics = %v; want %v", stat, want)
+	}
+
+	m = newTestMultiInstancePlugin(t, map[string]Plugin{"down": testPFailing{}})
+	if _, err := m.FetchMetrics(); err == nil || errors.As(err, &pe) {
+		t.Errorf("FetchMetrics should return an error if all instances fail: %v", err)
+	}
+}
+
+func TestMultiInstancePluginOutputValues(t *testing.T) {
+	m := newTestMultiInstancePlugin(t, map[string]Plugin{
+		"a": testMemcachedPlugin{},
+		"b": testMemcachedPlugin{},
+	})
+	mp := NewMackerelPlugin(m)
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Now().Unix()
+	expect := fmt.Sprintf("memcached.cmd.a.cmd_get\t11\t%[1]d\nmemcached.cmd.b.cmd_get\t11\t%[1]d\n", epoch)
+	if got := wtr.String(); sortLines(got) != sortLines(expect) {
+		t.Errorf("result of OutputValues is invalid :%s", got)
+	}
+	if problems := mp.Validate(); problems != nil {
+		t.Errorf("Validate = %q; want nil", problems)
+	}
+}
+
+func TestMultiInstancePluginDiffPerInstance(t *testing.T) {
+	var n1, n2 int
+	n2 = 10
+	m := newTestMultiInstancePlugin(t, map[string]Plugin{
+		"a": testPCounter{n: &n1, cancel: func() {}},
+		"b": testPCounter{n: &n2, cancel: func() {}},
+	})
+	mp := NewMackerelPlugin(m)
+	mp.StateStore = &MemoryStateStore{}
+	mp.Writer = &bytes.Buffer{}
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := mp.StateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Values["counter.a.count"] != Float(1) || state.Values["counter.b.count"] != Float(11) {
+		t.Errorf("state should be kept for each instance: %v", state.Values)
+	}
+}
+
+func TestMultiInstancePluginWithCompositePlugin(t *testing.T) {
+	c, err := NewCompositePlugin(testP{}, testPSameNames{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestMultiInstancePlugin(t, map[string]Plugin{"a": c})
+	stat, err := m.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"testP.a.bar":       15,
+		"testP.fuga.a.baz":  18,
+		"app.cmd.a.cmd_get": 20,
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics = %v; want %v", stat, want)
+	}
+}
+
+func TestMultiInstancePluginCollision(t *testing.T) {
+	_, err := NewMultiInstancePlugin(map[string]Plugin{
+		"host:1": testPWithWildcard{},
+		"host_1": testPWithWildcard{},
+		"host-2": testPWithWildcard{},
+	})
+	var defErr *DefinitionError
+	if !errors.As(err, &defErr) {
+		t.Fatalf("NewMultiInstancePlugin: %v; want *DefinitionError", err)
+	}
+	if want := "instance names collide: host_1 (host:1, host_1)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("NewMultiInstancePlugin: %v; want to contain %q", err, want)
+	}
+}
@@ -0,0 +1,356 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State represents last values used to calculate differentials
+type State struct {
+	Values map[string]Value
+	Time   time.Time
+	// LastSeen is the time when each value was fetched last.
+	LastSeen map[string]time.Time
+	// Prefix is the metric key prefix of the plugin which saved the state.
+	Prefix string
+}
+
+// lookup returns the value of key and the time when it was fetched last.
+// It is safe to call lookup on nil State.
+func (s *State) lookup(key string) (Value, time.Time, bool) {
+	if s == nil {
+		return Value{}, time.Time{}, false
+	}
+	v, ok := s.Values[key]
+	if !ok {
+		return Value{}, time.Time{}, false
+	}
+	t, ok := s.LastSeen[key]
+	if !ok {
+		t = s.Time
+	}
+	return v, t, true
+}
+
+// StateStore loads and saves the State between runs of a plugin.
+// Load returns nil State if nothing has been saved.
+type StateStore interface {
+	Load() (*State, error)
+	Save(state *State) error
+}
+
+// StateLocker is implemented by StateStore which can be locked exclusively
+// during a read-compute-write cycle. If wait is false and the state is already locked,
+// Lock returns ErrStateLocked.
+type StateLocker interface {
+	Lock(wait bool) (unlock func() error, err error)
+}
+
+// ErrStateLocked is returned when the state is locked by another process
+var ErrStateLocked = errors.New("state is locked by another process")
+
+// LockMode specifies the behavior of OutputValues when the state is locked by another process
+type LockMode int
+
+// Lock modes
+const (
+	LockWait LockMode = iota // wait until the lock is released
+	LockSkip                 // output nothing and exit successfully
+	LockFail                 // return an error
+)
+
+// FileStateStore is a StateStore which saves the State into a JSON file.
+// It is used by MackerelPlugin unless StateStore is specified.
+//
+// The file is written in the versioned format below. Legacy files, which are
+// flat objects of values with "_lastTime" key, are also read transparently.
+//
+//	{"version":2,"prefix":"memcached","time":1624848982000000000,"values":{"cmd_get":100},"last_seen":{"cmd_get":1624848982000000000}}
+type FileStateStore struct {
+	Path string
+}
+
+const stateFormatVersion = 2
+
+type stateFile struct {
+	Version  int              `json:"version"`
+	Prefix   string           `json:"prefix,omitempty"`
+	Time     int64            `json:"time"`
+	Values   map[string]Value `json:"values"`
+	LastSeen map[string]int64 `json:"last_seen,omitempty"`
+}
+
+// Load implements StateStore
+func (s *FileStateStore) Load() (*State, error) {
+	b, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, &StateError{Op: "read", Path: s.Path, Err: err}
+	}
+	state, err := decodeState(b)
+	if err != nil {
+		return nil, &StateError{Op: "read", Path: s.Path, Err: err}
+	}
+	return state, nil
+}
+
+func decodeState(b []byte) (*State, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	// Values of the legacy format are always numbers.
+	if v, ok := fields["values"]; !ok || !bytes.HasPrefix(bytes.TrimSpace(v), []byte("{")) {
+		return decodeLegacyState(b)
+	}
+
+	var f stateFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Version > stateFormatVersion {
+		return nil, fmt.Errorf("unsupported state format version: %d", f.Version)
+	}
+	state := &State{
+		Values:   f.Values,
+		Time:     time.Unix(0, f.Time),
+		LastSeen: make(map[string]time.Time, len(f.LastSeen)),
+		Prefix:   f.Prefix,
+	}
+	if state.Values == nil {
+		state.Values = make(map[string]Value)
+	}
+	for k, t := range f.LastSeen {
+		state.LastSeen[k] = time.Unix(0, t)
+	}
+	return state, nil
+}
+
+func decodeLegacyState(b []byte) (*State, error) {
+	stat := make(map[string]float64)
+	if err := json.Unmarshal(b, &stat); err != nil {
+		return nil, err
+	}
+	t := time.Unix(int64(stat["_lastTime"]), 0)
+	delete(stat, "_lastTime")
+	values := floatValues(stat)
+	lastSeen := make(map[string]time.Time, len(values))
+	for k := range values {
+		lastSeen[k] = t
+	}
+	return &State{Values: values, Time: t, LastSeen: lastSeen}, nil
+}
+
+// Save implements StateStore.
+// The file is replaced atomically so that readers never see a partially written state.
+func (s *FileStateStore) Save(state *State) error {
+	sf := stateFile{
+		Version:  stateFormatVersion,
+		Prefix:   state.Prefix,
+		Time:     state.Time.UnixNano(),
+		Values:   state.Values,
+		LastSeen: make(map[string]int64, len(state.LastSeen)),
+	}
+	for k, t := range state.LastSeen {
+		sf.LastSeen[k] = t.UnixNano()
+	}
+	err := writeFileAtomically(s.Path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(sf)
+	})
+	if err != nil {
+		return &StateError{Op: "write", Path: s.Path, Err: err}
+	}
+	return nil
+}
+
+// writeFileAtomically writes a temporary file in the same directory with write and renames it to path.
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint
+	defer f.Close()           // nolint
+
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Lock implements StateLocker with an advisory lock on Path + ".lock".
+func (s *FileStateStore) Lock(wait bool) (func() error, error) {
+	unlock, err := lockFile(s.Path+".lock", wait)
+	if err != nil {
+		return nil, &StateError{Op: "lock", Path: s.Path, Err: err}
+	}
+	return unlock, nil
+}
+
+// MemoryStateStore is a StateStore which keeps the State in memory.
+// It is useful for tests and long-running processes.
+type MemoryStateStore struct {
+	mu    sync.Mutex
+	state *State
+}
+
+// Load implements StateStore
+func (s *MemoryStateStore) Load() (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return nil, nil
+	}
+	return copyState(s.state), nil
+}
+
+// Save implements StateStore
+func (s *MemoryStateStore) Save(state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = copyState(state)
+	return nil
+}
+
+func copyState(state *State) *State {
+	values := make(map[string]Value, len(state.Values))
+	for k, v := range state.Values {
+		values[k] = v
+	}
+	lastSeen := make(map[string]time.Time, len(state.LastSeen))
+	for k, t := range state.LastSeen {
+		lastSeen[k] = t
+	}
+	return &State{Values: values, Time: state.Time, LastSeen: lastSeen, Prefix: state.Prefix}
+}
+
+// DirStateStore is a StateStore which saves each value into its own file under Dir.
+// Each file is named after the escaped key with ".state" suffix and contains the value
+// and the time it was seen last. Other files in Dir are left untouched.
+// Prefix of the State is not saved.
+type DirStateStore struct {
+	Dir string
+}
+
+const dirStateSuffix = ".state"
+
+// stateKey returns the key of the value saved in e, or false if e is not a state entry.
+func (s *DirStateStore) stateKey(e os.DirEntry) (string, bool) {
+	name, ok := strings.CutSuffix(e.Name(), dirStateSuffix)
+	if !ok || !e.Type().IsRegular() {
+		return "", false
+	}
+	key, err := url.PathUnescape(name)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// Load implements StateStore
+func (s *DirStateStore) Load() (*State, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, &StateError{Op: "read", Path: s.Dir, Err: err}
+	}
+	var state *State
+	for _, e := range entries {
+		key, ok := s.stateKey(e)
+		if !ok {
+			continue
+		}
+		file := filepath.Join(s.Dir, e.Name())
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, &StateError{Op: "read", Path: file, Err: err}
+		}
+		value, t, err := parseStateEntry(string(b))
+		if err != nil {
+			return nil, &StateError{Op: "read", Path: file, Err: err}
+		}
+		if state == nil {
+			state = &State{Values: make(map[string]Value), LastSeen: make(map[string]time.Time)}
+		}
+		state.Values[key] = value
+		state.LastSeen[key] = t
+		if t.After(state.Time) {
+			state.Time = t
+		}
+	}
+	return state, nil
+}
+
+func parseStateEntry(s string) (Value, time.Time, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Value{}, time.Time{}, fmt.Errorf("malformed entry: %q", s)
+	}
+	value, err := parseValue(fields[0])
+	if err != nil {
+		return Value{}, time.Time{}, err
+	}
+	nsec, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Value{}, time.Time{}, err
+	}
+	return value, time.Unix(0, nsec), nil
+}
+
+// Save implements StateStore.
+// Each file is replaced atomically so that readers never see a partially written value.
+func (s *DirStateStore) Save(state *State) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return &StateError{Op: "write", Path: s.Dir, Err: err}
+	}
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return &StateError{Op: "write", Path: s.Dir, Err: err}
+	}
+	// Values which are not in the state any longer are removed.
+	for _, e := range entries {
+		key, ok := s.stateKey(e)
+		if !ok {
+			continue
+		}
+		if _, ok := state.Values[key]; !ok {
+			file := filepath.Join(s.Dir, e.Name())
+			if err := os.Remove(file); err != nil {
+				return &StateError{Op: "write", Path: file, Err: err}
+			}
+		}
+	}
+	for key, value := range state.Values {
+		file := filepath.Join(s.Dir, url.PathEscape(key)+dirStateSuffix)
+		t, ok := state.LastSeen[key]
+		if !ok {
+			t = state.Time
+		}
+		entry := value.text() + " " + strconv.FormatInt(t.UnixNano(), 10) + "\n"
+		err := writeFileAtomically(file, func(w io.Writer) error {
+			_, err := io.WriteString(w, entry)
+			return err
+		})
+		if err != nil {
+			return &StateError{Op: "write", Path: file, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testStateStore(t *testing.T, s StateStore) {
+	t.Helper()
+	state, err := s.Load()
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+	if state != nil {
+		t.Fatalf("Load: %v; want nil before Save", state)
+	}
+
+	now := time.Unix(1624848982, 0)
+	for _, values := range []map[string]Value{
+		{"key1": Float(1.5), "key2": Float(3), "key3": Uint(math.MaxUint64), "key4": Int(-1)},
+		{"key1": Float(2.5)},
+	} {
+		if err := s.Save(&State{Values: values, Time: now}); err != nil {
+			t.Fatal("Save:", err)
+		}
+		state, err = s.Load()
+		if err != nil {
+			t.Fatal("Load:", err)
+		}
+		if !state.Time.Equal(now) {
+			t.Errorf("Time = %v; want %v", state.Time, now)
+		}
+		if !reflect.DeepEqual(state.Values, values) {
+			t.Errorf("Values = %v; want %v", state.Values, values)
+		}
+	}
+}
+
+func TestFileStateStore(t *testing.T) {
+	testStateStore(t, &FileStateStore{Path: filepath.Join(t.TempDir(), "state.json")})
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testStateStore(t, &MemoryStateStore{})
+}
+
+func TestDirStateStore(t *testing.T) {
+	testStateStore(t, &DirStateStore{Dir: filepath.Join(t.TempDir(), "state")})
+}
+
+func TestDirStateStoreWithForeignFile(t *testing.T) {
+	dir := t.TempDir()
+	readme := filepath.Join(dir, "README")
+	if err := os.WriteFile(readme, []byte("important"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &DirStateStore{Dir: dir}
+	if state, err := s.Load(); err != nil || state != nil {
+		t.Errorf("Load = %v, %v; want nil, nil", state, err)
+	}
+	state := &State{Values: map[string]Value{"cmd_get": Int(100)}, Time: time.Unix(1624848982, 0)}
+	if err := s.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(readme); err != nil || string(b) != "important" {
+		t.Errorf("Save should leave other files untouched: %q, %v", b, err)
+	}
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Values, state.Values) {
+		t.Errorf("Load = %v; want %v", loaded.Values, state.Values)
+	}
+}
+
+func TestOutputValuesWithStateStore(t *testing.T) {
+	var n int
+	mp := NewMackerelPlugin(testPCounter{n: &n, cancel: func() {}})
+	mp.StateStore = &MemoryStateStore{}
+	mp.Writer = &bytes.Buffer{}
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := mp.StateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.Values["count"] != Float(1) {
+		t.Errorf("OutputValuesE should save values to StateStore: %v", state)
+	}
+}
+
+func TestFileStateStoreReadsLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"cmd_get":100,"values":3,"_lastTime":1624848982}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &FileStateStore{Path: path}
+	state, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastTime := time.Unix(1624848982, 0)
+	want := &State{
+		Values:   map[string]Value{"cmd_get": Float(100), "values": Float(3)},
+		Time:     lastTime,
+		LastSeen: map[string]time.Time{"cmd_get": lastTime, "values": lastTime},
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("Load = %+v; want %+v", state, want)
+	}
+}
+
+func TestFileStateStoreKeepsPerKeyTimestamps(t *testing.T) {
+	s := &FileStateStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	now := time.Unix(1624848982, 123456789)
+	want := &State{
+		// a metric named _lastTime no longer collides with the timestamp
+		Values:   map[string]Value{"_lastTime": Float(1), "key1": Int(2)},
+		Time:     now,
+		LastSeen: map[string]time.Time{"_lastTime": now, "key1": now.Add(-time.Minute)},
+		Prefix:   "foo.bar",
+	}
+	if err := s.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	state, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("Load = %+v; want %+v", state, want)
+	}
+}
+
+func TestFileStateStoreRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"version":100,"time":0,"values":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &FileStateStore{Path: path}
+	if _, err := s.Load(); err == nil {
+		t.Error("Load should return an error for unsupported versions")
+	}
+}
+
+func TestFetchLastValuesIgnoresStateOfAnotherPrefix(t *testing.T) {
+	mp := NewMackerelPlugin(testPHasDiff{})
+	mp.StateStore = &MemoryStateStore{}
+	now := time.Now()
+	err := mp.StateStore.Save(&State{
+		Values: map[string]Value{"hoge1": Float(1)},
+		Time:   now.Add(-time.Minute),
+		Prefix: "another",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := mp.fetchLastValues(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != nil {
+		t.Errorf("fetchLastValues = %v; want nil", last)
+	}
+}
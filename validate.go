@@ -0,0 +1,147 @@
+package mackerelplugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Problem represents a mistake in graph definitions found by Validate
+type Problem struct {
+	Graph   string
+	Metric  string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Metric == "" {
+		return fmt.Sprintf("graph %q: %s", p.Graph, p.Message)
+	}
+	return fmt.Sprintf("graph %q, metric %q: %s", p.Graph, p.Metric, p.Message)
+}
+
+var units = map[string]bool{
+	UnitFloat:          true,
+	UnitInteger:        true,
+	UnitPercentage:     true,
+	UnitSeconds:        true,
+	UnitMilliseconds:   true,
+	UnitBytes:          true,
+	UnitBytesPerSecond: true,
+	UnitBitsPerSecond:  true,
+	UnitIOPS:           true,
+}
+
+var keySegmentReg = regexp.MustCompile(`\A(?:[-a-zA-Z0-9_*#]+)\z`)
+var metricNameReg = regexp.MustCompile(`\A(?:[-a-zA-Z0-9_]+|[*#])\z`)
+
+// Validate checks graph definitions for mistakes which make graphs silently missing in Mackerel.
+// It returns nil if no problems are found.
+func (mp *MackerelPlugin) Validate() []Problem {
+	var problems []Problem
+	add := func(graph, metric, format string, args ...interface{}) {
+		problems = append(problems, Problem{Graph: graph, Metric: metric, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if prefix := mp.metricKeyPrefix(); prefix != "" {
+		if msg := validateKey(prefix); msg != "" {
+			add("", "", "metric key prefix %q %s", prefix, msg)
+		}
+	}
+
+	// Some plugins key values with their graph keys, so the same metric names in different graphs never collide.
+	qualified := usesQualifiedKeys(mp.Plugin)
+
+	graphs := mp.GraphDefinition()
+	keys := sortedKeys(graphs)
+	// keys of stat read by graphs without wildcards
+	owners := make(map[string]string)
+	for _, key := range keys {
+		graph := graphs[key]
+		if key != "" {
+			if msg := validateKey(key); msg != "" {
+				add(key, "", "graph key %s", msg)
+			}
+		}
+		if graph.Unit != "" && !units[graph.Unit] {
+			add(key, "", "unknown unit %q", graph.Unit)
+		}
+		if len(graph.Metrics) == 0 {
+			add(key, "", "no metrics")
+		}
+
+		wildcard := strings.ContainsAny(key, "*#")
+		names := make(map[string]bool)
+		for _, metric := range graph.Metrics {
+			name := metric.Name
+			if !metricNameReg.MatchString(name) {
+				add(key, name, "metric name must consist of [-a-zA-Z0-9_] or be a wildcard")
+			}
+			if _, ok := names[name]; ok {
+				add(key, name, "duplicate metric name in the graph")
+			} else if !wildcard && !strings.ContainsAny(name, "*#") && metric.Expr == "" {
+				k := name
+				if qualified || metric.Qualified {
+					k = joinKey(key, name)
+				}
+				if owner, ok := owners[k]; ok {
+					add(key, name, "duplicate metric name; also defined in graph %q", owner)
+				} else {
+					owners[k] = key
+				}
+			}
+			names[name] = metric.Expr == ""
+			if metric.DiffMode < DiffPerMinute || metric.DiffMode > DiffDelta {
+				add(key, name, "unknown diff mode %d", metric.DiffMode)
+			}
+			if metric.CounterBits != 0 && metric.CounterBits != 32 && metric.CounterBits != 64 {
+				add(key, name, "counter bits must be 32 or 64")
+			}
+		}
+
+		for _, metric := range graph.Metrics {
+			if metric.Expr == "" {
+				continue
+			}
+			if strings.ContainsAny(metric.Name, "*#") {
+				add(key, metric.Name, "derived metric can not be a wildcard")
+			}
+			e, err := parseExpr(metric.Expr)
+			if err != nil {
+				add(key, metric.Name, "invalid expression: %v", err)
+				continue
+			}
+			for _, n := range exprNames(e) {
+				if !names[n] {
+					add(key, metric.Name, "expression refers to %q, which is not a non-derived metric of the graph", n)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// validateKey returns why the key can never be output or matched, or empty string.
+func validateKey(key string) string {
+	for _, seg := range strings.Split(key, ".") {
+		if seg == "" {
+			return "has an empty segment"
+		}
+		if !keySegmentReg.MatchString(seg) {
+			return "must consist of [-a-zA-Z0-9_] and wildcards"
+		}
+	}
+	return ""
+}
+
+// validate prints problems of graph definitions and returns an error if any.
+func (mp *MackerelPlugin) validate() error {
+	problems := mp.Validate()
+	for _, p := range problems {
+		fmt.Fprintln(mp.getWriter(), p) // nolint
+	}
+	if len(problems) > 0 {
+		return &DefinitionError{Err: fmt.Errorf("%d problems found", len(problems))}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testPInvalid struct{}
+
+func (t testPInvalid) FetchMetrics() (map[string]float64, error) {
+	return nil, nil
+}
+
+func (t testPInvalid) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"a": {
+			Unit: "bytes/min",
+			Metrics: []Metrics{
+				{Name: "cmd.get"},
+				{Name: "hits"},
+				{Name: "hits"},
+				{Name: "ratio", Expr: "hits / misses"},
+				{Name: "count", CounterBits: 16, DiffMode: 5},
+			},
+		},
+		"b": {
+			Unit: UnitInteger,
+			Metrics: []Metrics{
+				{Name: "hits"},
+			},
+		},
+		"c..#": {
+			Metrics: []Metrics{
+				{Name: "bar"},
+			},
+		},
+		"d.(#)": {
+			Metrics: []Metrics{
+				{Name: "bar"},
+			},
+		},
+	}
+}
+
+func (t testPInvalid) MetricKeyPrefix() string {
+	return "my/plugin"
+}
+
+func TestValidate(t *testing.T) {
+	mp := NewMackerelPlugin(testPInvalid{})
+	got := mp.Validate()
+	want := []Problem{
+		{"", "", `metric key prefix "my/plugin" must consist of [-a-zA-Z0-9_] and wildcards`},
+		{"a", "", `unknown unit "bytes/min"`},
+		{"a", "cmd.get", "metric name must consist of [-a-zA-Z0-9_] or be a wildcard"},
+		{"a", "hits", "duplicate metric name in the graph"},
+		{"a", "count", "unknown diff mode 5"},
+		{"a", "count", "counter bits must be 32 or 64"},
+		{"a", "ratio", `expression refers to "misses", which is not a non-derived metric of the graph`},
+		{"b", "hits", `duplicate metric name; also defined in graph "a"`},
+		{"c..#", "", "graph key has an empty segment"},
+		{"d.(#)", "", "graph key must consist of [-a-zA-Z0-9_] and wildcards"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestValidateValidDefinitions(t *testing.T) {
+	for _, p := range []Plugin{testP{}, testPWithWildcard{}, testPWithDerived{}, testMemcachedPlugin{}} {
+		mp := NewMackerelPlugin(p)
+		if problems := mp.Validate(); problems != nil {
+			t.Errorf("Validate(%T) = %q; want nil", p, problems)
+		}
+	}
+}
+
+func TestRunWithValidateEnv(t *testing.T) {
+	t.Setenv("MACKEREL_PLUGIN_VALIDATE", "1")
+	mp := NewMackerelPlugin(testPInvalid{})
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	err := mp.RunE()
+	var defErr *DefinitionError
+	if !errors.As(err, &defErr) {
+		t.Errorf("RunE: %v; want *DefinitionError", err)
+	}
+	if wtr.Len() == 0 {
+		t.Error("RunE should print problems")
+	}
+
+	mp = NewMackerelPlugin(testP{})
+	wtr = &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.RunE(); err != nil {
+		t.Errorf("RunE: %v", err)
+	}
+	if wtr.Len() != 0 {
+		t.Errorf("RunE should print nothing: %s", wtr.String())
+	}
+}
@@ -0,0 +1,208 @@
+package mackerelplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Value is a metric value. Unlike float64, it keeps 64-bit integers exactly.
+// The zero value is a float 0.
+type Value struct {
+	kind valueKind
+	f    float64
+	i    int64
+	u    uint64
+	t    time.Time
+}
+
+type valueKind int
+
+const (
+	floatValue valueKind = iota
+	intValue
+	uintValue
+)
+
+// Float returns a Value of floating point number
+func Float(f float64) Value {
+	return Value{kind: floatValue, f: f}
+}
+
+// Int returns a Value of signed integer
+func Int(i int64) Value {
+	return Value{kind: intValue, i: i}
+}
+
+// Uint returns a Value of unsigned integer
+func Uint(u uint64) Value {
+	return Value{kind: uintValue, u: u}
+}
+
+// At returns v sampled at t. The value is output with t instead of the time of fetching,
+// and its differential is calculated with the time elapsed since the last sample.
+func (v Value) At(t time.Time) Value {
+	v.t = t
+	return v
+}
+
+// Time returns the time set by At, or zero Time if it is not set.
+func (v Value) Time() time.Time {
+	return v.t
+}
+
+func (v Value) timeOr(now time.Time) time.Time {
+	if v.t.IsZero() {
+		return now
+	}
+	return v.t
+}
+
+// Float64 returns v as float64, which may lose precision of large integers.
+func (v Value) Float64() float64 {
+	switch v.kind {
+	case intValue:
+		return float64(v.i)
+	case uintValue:
+		return float64(v.u)
+	}
+	return v.f
+}
+
+// String returns the shortest representation of v which is parsed back exactly.
+func (v Value) String() string {
+	switch v.kind {
+	case intValue:
+		return strconv.FormatInt(v.i, 10)
+	case uintValue:
+		return strconv.FormatUint(v.u, 10)
+	}
+	return strconv.FormatFloat(v.f, 'g', -1, 64)
+}
+
+// text returns the representation of v which is parsed back into the same kind of Value.
+func (v Value) text() string {
+	s := v.String()
+	if v.kind == floatValue && !strings.ContainsAny(s, ".eEnN") {
+		s += ".0"
+	}
+	return s
+}
+
+// MarshalJSON implements json.Marshaler.
+// Floats are marshaled with a decimal point or an exponent to be distinguished from integers.
+func (v Value) MarshalJSON() ([]byte, error) {
+	if !v.isFinite() {
+		return nil, fmt.Errorf("unsupported value: %v", v)
+	}
+	return []byte(v.text()), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (v *Value) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	x, err := parseValue(string(n))
+	if err != nil {
+		return err
+	}
+	*v = x
+	return nil
+}
+
+// parseValue parses s as an integer if possible, or a floating point number.
+func parseValue(s string) (Value, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return Int(i), nil
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return Uint(u), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Value{}, err
+	}
+	return Float(f), nil
+}
+
+func (v Value) isFinite() bool {
+	return v.kind != floatValue || !(math.IsNaN(v.f) || math.IsInf(v.f, 0))
+}
+
+// unsigned returns v as uint64 if v is a non-negative integer.
+func (v Value) unsigned() (uint64, bool) {
+	switch v.kind {
+	case intValue:
+		return uint64(v.i), v.i >= 0
+	case uintValue:
+		return v.u, true
+	}
+	return 0, false
+}
+
+var errCounterReset = errors.New("counter seems to be reset")
+
+// counterDelta returns the increase of the counter from last to v.
+// Non-negative integers are subtracted in integer arithmetic to keep 64-bit counters exact.
+func counterDelta(metric Metrics, v Value, last Value) (Value, error) {
+	cur, ok1 := v.unsigned()
+	prev, ok2 := last.unsigned()
+	if !ok1 || !ok2 {
+		delta := v.Float64() - last.Float64()
+		if delta < 0 {
+			switch {
+			case metric.CounterBits == 32 && last.Float64() <= math.MaxUint32:
+				delta += 1 << 32
+			case metric.CounterBits == 64:
+				delta += 1 << 64
+			case metric.ResetAsZero:
+				delta = v.Float64()
+			default:
+				return Value{}, errCounterReset
+			}
+		}
+		return Float(delta), nil
+	}
+	if cur < prev {
+		switch {
+		case metric.CounterBits == 32 && prev <= math.MaxUint32:
+			return Uint(cur + (1<<32 - prev)), nil
+		case metric.CounterBits == 64:
+			// Subtraction of uint64 wraps around at 64 bits.
+			return Uint(cur - prev), nil
+		case metric.ResetAsZero:
+			return Uint(cur), nil
+		default:
+			return Value{}, errCounterReset
+		}
+	}
+	return Uint(cur - prev), nil
+}
+
+func floatValues(stat map[string]float64) map[string]Value {
+	if stat == nil {
+		return nil
+	}
+	values := make(map[string]Value, len(stat))
+	for k, v := range stat {
+		values[k] = Float(v)
+	}
+	return values
+}
+
+func float64Values(values map[string]Value) map[string]float64 {
+	if values == nil {
+		return nil
+	}
+	stat := make(map[string]float64, len(values))
+	for k, v := range values {
+		stat[k] = v.Float64()
+	}
+	return stat
+}
@@ -0,0 +1,187 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValueString(t *testing.T) {
+	tests := []struct {
+		v      Value
+		expect string
+		tsv    string
+	}{
+		{Float(1.5), "1.5", "1.500000"},
+		{Float(3), "3", "3"},
+		{Float(1e20), "1e+20", "100000000000000000000"},
+		{Int(-9007199254740993), "-9007199254740993", "-9007199254740993"},
+		{Uint(math.MaxUint64), "18446744073709551615", "18446744073709551615"},
+	}
+	for _, tt := range tests {
+		if got := tt.v.String(); got != tt.expect {
+			t.Errorf("String = %q; want %q", got, tt.expect)
+		}
+		if got := formatTSVValue(tt.v); got != tt.tsv {
+			t.Errorf("formatTSVValue(%v) = %q; want %q", tt.v, got, tt.tsv)
+		}
+	}
+}
+
+func TestValueJSON(t *testing.T) {
+	values := map[string]Value{
+		"float":    Float(3),
+		"fraction": Float(0.25),
+		"int":      Int(-1),
+		"uint":     Uint(math.MaxUint64),
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"float":3.0,"fraction":0.25,"int":-1,"uint":18446744073709551615}`
+	if string(b) != expect {
+		t.Errorf("Marshal = %s; want %s", b, expect)
+	}
+	var got map[string]Value
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("Unmarshal = %v; want %v", got, values)
+	}
+	if _, err := json.Marshal(Float(math.NaN())); err == nil {
+		t.Error("Marshal should fail for NaN")
+	}
+}
+
+func TestCalcDiffWithIntegers(t *testing.T) {
+	var mp *MackerelPlugin
+
+	now := time.Unix(1437227240, 0)
+	tests := []struct {
+		name      string
+		metric    Metrics
+		value     Value
+		lastValue Value
+		want      Value
+	}{
+		{"large counter", Metrics{DiffMode: DiffDelta}, Uint(1<<63 + 10), Uint(1 << 63), Uint(10)},
+		{"64bit wraparound", Metrics{DiffMode: DiffDelta, CounterBits: 64}, Uint(5), Uint(math.MaxUint64 - 4), Uint(10)},
+		{"32bit wraparound", Metrics{DiffMode: DiffDelta, CounterBits: 32}, Int(5), Int(math.MaxUint32 - 4), Uint(10)},
+		{"reset as zero", Metrics{DiffMode: DiffDelta, ResetAsZero: true}, Int(5), Int(100), Uint(5)},
+		{"per minute", Metrics{}, Uint(1<<63 + 60), Uint(1 << 63), Float(60)},
+		{"mixed with float", Metrics{DiffMode: DiffDelta}, Float(2.5), Int(1), Float(1.5)},
+	}
+	for _, tt := range tests {
+		diff, err := mp.calcDiff(tt.metric, tt.value, now, tt.lastValue, now.Add(-time.Minute))
+		if err != nil {
+			t.Errorf("%s: calcDiff returns an error %v", tt.name, err)
+			continue
+		}
+		if diff != tt.want {
+			t.Errorf("%s: calcDiff = %v; want %v", tt.name, diff, tt.want)
+		}
+	}
+
+	if _, err := mp.calcDiff(Metrics{}, Uint(1), now, Uint(2), now.Add(-time.Minute)); err == nil {
+		t.Error("calcDiff with counter reset should cause an error")
+	}
+}
+
+type testPWithValues struct {
+	testPHasDiff
+	values map[string]Value
+}
+
+func (t testPWithValues) FetchMetricValues(ctx context.Context) (map[string]Value, error) {
+	return t.values, nil
+}
+
+func TestOutputValuesWithValues(t *testing.T) {
+	mp := NewMackerelPlugin(testPWithValues{values: map[string]Value{"hoge1": Uint(1<<63 + 120)}})
+	mp.StateStore = &MemoryStateStore{}
+	now := time.Now()
+	err := mp.StateStore.Save(&State{
+		Values: map[string]Value{"hoge1": Uint(1 << 63)},
+		Time:   now.Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	mp.Clock = &testClock{now: now}
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("hoge.hoge1\t120\t%d\n", now.Unix())
+	if got := wtr.String(); got != expect {
+		t.Errorf("OutputValuesE outputs %q; want %q", got, expect)
+	}
+}
+
+func TestOutputValuesWithTimestamps(t *testing.T) {
+	sampled := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+	store := &MemoryStateStore{}
+	mp := NewMackerelPlugin(testPWithValues{values: map[string]Value{"hoge1": Int(300).At(sampled)}})
+	mp.StateStore = store
+	err := store.Save(&State{
+		Values:   map[string]Value{"hoge1": Int(100)},
+		Time:     time.Now().Add(-time.Minute),
+		LastSeen: map[string]time.Time{"hoge1": sampled.Add(-4 * time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	// 200 in 4 minutes between the samples
+	expect := fmt.Sprintf("hoge.hoge1\t50\t%d\n", sampled.Unix())
+	if got := wtr.String(); got != expect {
+		t.Errorf("OutputValuesE outputs %q; want %q", got, expect)
+	}
+	state, _ := store.Load()
+	if !state.LastSeen["hoge1"].Equal(sampled) {
+		t.Errorf("LastSeen = %v; want %v", state.LastSeen["hoge1"], sampled)
+	}
+	if !state.Values["hoge1"].Time().IsZero() {
+		t.Errorf("saved values should not have timestamps: %v", state.Values["hoge1"].Time())
+	}
+}
+
+func TestOutputValuesWithSubsecondTimestamps(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := base.Add(700 * time.Millisecond)
+	sampled := last.Add(59500 * time.Millisecond)
+	store := &MemoryStateStore{}
+	mp := NewMackerelPlugin(testPWithValues{values: map[string]Value{"hoge1": Int(695).At(sampled)}})
+	mp.StateStore = store
+	mp.Clock = &testClock{now: base.Add(61 * time.Second)}
+	err := store.Save(&State{
+		Values:   map[string]Value{"hoge1": Int(100)},
+		Time:     base.Add(time.Second),
+		LastSeen: map[string]time.Time{"hoge1": last},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtr := &bytes.Buffer{}
+	mp.Writer = wtr
+	if err := mp.OutputValuesE(); err != nil {
+		t.Fatal(err)
+	}
+	// 595 in 59.5 seconds between the samples, not in 60 seconds between their Unix times
+	expect := fmt.Sprintf("hoge.hoge1\t600\t%d\n", sampled.Unix())
+	if got := wtr.String(); got != expect {
+		t.Errorf("OutputValuesE outputs %q; want %q", got, expect)
+	}
+}